@@ -16,6 +16,7 @@ import (
 
 	"github.com/oyberntzen/Raycasting-in-Golang/game"
 	"github.com/oyberntzen/Raycasting-in-Golang/game/levels"
+	"github.com/oyberntzen/Raycasting-in-Golang/game/physics"
 	"github.com/oyberntzen/Raycasting-in-Golang/networking"
 )
 
@@ -24,7 +25,7 @@ var (
 	images   []ebiten.Image
 )
 
-//Init inits all textures
+//Init inits all textures. It can be called again to reload them
 func Init(dir string, width, height int) {
 	textures = []image.Image{
 		load(dir + "brick_circle.png"),
@@ -41,9 +42,12 @@ func Init(dir string, width, height int) {
 		load(dir + "player.png"),
 		load(dir + "pistol.png"),
 		load(dir + "cursor.png"),
+		load(dir + "health.png"),
+	}
+	images = []ebiten.Image{
+		*resizeImage(textures[13], int(float64(width)/50)+1, 0), //Cursor
+		*resizeImage(textures[12], int(float64(width)/5)+1, 0),  //Pistol
 	}
-	images = append(images, *resizeImage(textures[13], int(float64(width)/50)+1, 0)) //Cursor
-	images = append(images, *resizeImage(textures[12], int(float64(width)/5)+1, 0))  //Pistol
 }
 
 //Draw3D draws walls, floor, ceiling and sprites from the first person view of the player
@@ -64,84 +68,6 @@ func Draw3D(screen *ebiten.Image, player networking.Player, cells [][]uint8, spr
 	drawUI(screen, width, height)
 }
 
-//Ray shoots ray from player and calculates distance to wall
-func Ray(player networking.Player, cells [][]uint8, rayDirX, rayDirY float64) (float64, float64, uint8) {
-	dist := float64(0)
-
-	curcell := [2]int{int(player.X), int(player.Y)}
-	curpos := [2]float64{player.X, player.Y}
-
-	side := 0
-
-	for {
-
-		relx := curpos[0] - float64(curcell[0])
-		rely := curpos[1] - float64(curcell[1])
-
-		hor := 1 - relx
-		if rayDirX <= 0 {
-			hor = -relx
-		}
-		ver := 1 - rely
-		if rayDirY <= 0 {
-			ver = -rely
-		}
-
-		var hormult float64
-		if rayDirX != 0 {
-			hormult = hor / rayDirX
-		} else {
-			hormult = 1000
-		}
-		var vermult float64
-		if rayDirY != 0 {
-			vermult = ver / rayDirY
-		} else {
-			vermult = 1000
-		}
-
-		horlen := math.Pow(hor, 2) + math.Pow(rayDirY*hormult, 2)
-		verlen := math.Pow(ver, 2) + math.Pow(rayDirX*vermult, 2)
-
-		var textureIndex float64
-		if horlen < verlen {
-			side = 0
-			if hor < 0 {
-				curcell = [2]int{curcell[0] - 1, curcell[1]}
-			} else {
-				curcell = [2]int{curcell[0] + 1, curcell[1]}
-			}
-			curpos = [2]float64{curpos[0] + hor, curpos[1] + rayDirY*hormult}
-			textureIndex = curpos[1] - float64(curcell[1])
-
-		} else {
-			side = 1
-			if ver < 0 {
-				curcell = [2]int{curcell[0], curcell[1] - 1}
-			} else {
-				curcell = [2]int{curcell[0], curcell[1] + 1}
-			}
-			curpos = [2]float64{curpos[0] + rayDirX*vermult, curpos[1] + ver}
-			textureIndex = curpos[0] - float64(curcell[0])
-		}
-		dist = dist + math.Sqrt(math.Min(horlen, verlen))
-		var realDist float64
-		if side == 0 {
-			realDist = (curpos[0] - player.X) / rayDirX
-		} else {
-			realDist = (curpos[1] - player.Y) / rayDirY
-		}
-
-		if curcell[0] < 0 || curcell[0] >= len(cells[0]) ||
-			curcell[1] < 0 || curcell[1] >= len(cells) {
-			return realDist, textureIndex, 1
-		}
-		if cells[curcell[1]][curcell[0]] != 0 {
-			return realDist, textureIndex, cells[curcell[1]][curcell[0]]
-		}
-	}
-}
-
 func rayCast(player networking.Player, cells [][]uint8, width int, dirX, dirY, planeX, planeY float64) ([]float64, []float64, []uint8) {
 	dists := []float64{}
 	indicies := []float64{}
@@ -152,7 +78,7 @@ func rayCast(player networking.Player, cells [][]uint8, width int, dirX, dirY, p
 		rayDirX := dirX + planeX*cameraX
 		rayDirY := dirY + planeY*cameraX
 
-		dist, index, texture := Ray(player, cells, rayDirX, rayDirY)
+		dist, index, texture := physics.Ray(player, cells, rayDirX, rayDirY)
 		dists = append(dists, dist)
 		indicies = append(indicies, index)
 		texs = append(texs, texture)
@@ -1,6 +1,8 @@
 package levels
 
 import (
+	"math"
+
 	"github.com/oyberntzen/Raycasting-in-Golang/networking"
 )
 
@@ -19,6 +21,8 @@ var (
 	BarrelInfo SpriteInfo = SpriteInfo{8, 58, 64}
 	//PlayerInfo is used to create a player sprite in CreateSprite
 	PlayerInfo SpriteInfo = SpriteInfo{11, 32, 56}
+	//HealthInfo is used to create a health pickup in CreatePickup
+	HealthInfo SpriteInfo = SpriteInfo{14, 16, 16}
 )
 
 //SpriteZOption is used in CreateSprite. You can choose between the sprite hanging in the ceiling, sitting on the floor or a specified Z value.
@@ -33,10 +37,14 @@ const (
 	SpriteZFree SpriteZOption = 3
 )
 
-//Level is a struct for levels
+//Level is a struct for levels. Sprites never change, while Entities are the starting state of objects the server
+//updates while the game runs. Players spawn at SpawnX, SpawnY looking in SpawnAngle
 type Level struct {
-	Cells   [][]uint8
-	Sprites []networking.Sprite
+	Cells                      [][]uint8
+	Sprites                    []networking.Sprite
+	Entities                   []networking.Entity
+	Name                       string
+	SpawnX, SpawnY, SpawnAngle float64
 }
 
 //Level01 is the first level
@@ -109,6 +117,63 @@ var Level01 Level = Level{[][]uint8{
 		CreateSprite(BarrelInfo, 10.0, 15.1, 0, 0, 0.4, SpriteZFloor),
 		CreateSprite(BarrelInfo, 10.5, 15.8, 0, 0, 0.4, SpriteZFloor),
 	},
+	[]networking.Entity{
+		CreatePickup(HealthInfo, 20.5, 3.5),
+		CreatePickup(HealthInfo, 5.5, 9.5),
+		CreatePickup(HealthInfo, 14.5, 14.5),
+		CreatePickup(HealthInfo, 4.5, 21.5),
+	},
+	"Level01",
+	22.5, 10.5, -math.Pi / 2,
+}
+
+//Level02 is a small arena
+var Level02 Level = Level{[][]uint8{
+	{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1},
+	{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 3, 3, 0, 0, 0, 0, 0, 0, 3, 3, 0, 0, 1},
+	{1, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 6, 0, 0, 6, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 6, 0, 0, 6, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 1},
+	{1, 0, 0, 3, 3, 0, 0, 0, 0, 0, 0, 3, 3, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+	[]networking.Sprite{
+		CreateSprite(LampInfo, 7.5, 7.5, 0, 0.3, 0, SpriteZCeiling),
+		CreateSprite(LampInfo, 3.5, 7.5, 0, 0.3, 0, SpriteZCeiling),
+		CreateSprite(LampInfo, 11.5, 7.5, 0, 0.3, 0, SpriteZCeiling),
+
+		CreateSprite(BarrelInfo, 1.5, 1.5, 0, 0, 0.4, SpriteZFloor),
+		CreateSprite(BarrelInfo, 14.5, 1.5, 0, 0, 0.4, SpriteZFloor),
+		CreateSprite(BarrelInfo, 1.5, 14.5, 0, 0, 0.4, SpriteZFloor),
+		CreateSprite(BarrelInfo, 14.5, 14.5, 0, 0, 0.4, SpriteZFloor),
+	},
+	[]networking.Entity{
+		CreatePickup(HealthInfo, 7.5, 2.5),
+		CreatePickup(HealthInfo, 7.5, 13.5),
+	},
+	"Level02",
+	7.5, 7.5, 0,
+}
+
+//Levels are every level a server can load
+var Levels = []Level{Level01, Level02}
+
+//Find returns the level with the name
+func Find(name string) (Level, bool) {
+	for _, level := range Levels {
+		if level.Name == name {
+			return level, true
+		}
+	}
+	return Level{}, false
 }
 
 //CreateSprite creates a new sprite
@@ -135,6 +200,12 @@ func CreateSprite(spriteInfo SpriteInfo, x, y, z, width, height float64, zOption
 	return networking.Sprite{X: x, Y: y, Z: z, W: width, H: height, Texture: spriteInfo.Texture}
 }
 
+//CreatePickup creates a pickup lying on the floor. The server gives it an EntityID
+func CreatePickup(spriteInfo SpriteInfo, x, y float64) networking.Entity {
+	sprite := CreateSprite(spriteInfo, x, y, 0, 0.3, 0, SpriteZFloor)
+	return networking.Entity{Kind: networking.PickupEntity, State: networking.PickupAvailable, Sprite: sprite}
+}
+
 /*//CalculateZ calculates Z value of sprite when it is on the ground from height. Inverse value gives Z value of sprite when it hangs in the ceiling.
 func CalculateZ(H float64) float64 {
 	return -(1 - H) / 2
@@ -4,7 +4,6 @@ import (
 	"math"
 
 	"github.com/oyberntzen/Raycasting-in-Golang/game"
-	"github.com/oyberntzen/Raycasting-in-Golang/game/graphics"
 	"github.com/oyberntzen/Raycasting-in-Golang/networking"
 )
 
@@ -55,6 +54,84 @@ func round(number float64) int {
 	return int(number)
 }
 
+//Ray shoots ray from player and calculates distance to wall
+func Ray(player networking.Player, cells [][]uint8, rayDirX, rayDirY float64) (float64, float64, uint8) {
+	dist := float64(0)
+
+	curcell := [2]int{int(player.X), int(player.Y)}
+	curpos := [2]float64{player.X, player.Y}
+
+	side := 0
+
+	for {
+
+		relx := curpos[0] - float64(curcell[0])
+		rely := curpos[1] - float64(curcell[1])
+
+		hor := 1 - relx
+		if rayDirX <= 0 {
+			hor = -relx
+		}
+		ver := 1 - rely
+		if rayDirY <= 0 {
+			ver = -rely
+		}
+
+		var hormult float64
+		if rayDirX != 0 {
+			hormult = hor / rayDirX
+		} else {
+			hormult = 1000
+		}
+		var vermult float64
+		if rayDirY != 0 {
+			vermult = ver / rayDirY
+		} else {
+			vermult = 1000
+		}
+
+		horlen := math.Pow(hor, 2) + math.Pow(rayDirY*hormult, 2)
+		verlen := math.Pow(ver, 2) + math.Pow(rayDirX*vermult, 2)
+
+		var textureIndex float64
+		if horlen < verlen {
+			side = 0
+			if hor < 0 {
+				curcell = [2]int{curcell[0] - 1, curcell[1]}
+			} else {
+				curcell = [2]int{curcell[0] + 1, curcell[1]}
+			}
+			curpos = [2]float64{curpos[0] + hor, curpos[1] + rayDirY*hormult}
+			textureIndex = curpos[1] - float64(curcell[1])
+
+		} else {
+			side = 1
+			if ver < 0 {
+				curcell = [2]int{curcell[0], curcell[1] - 1}
+			} else {
+				curcell = [2]int{curcell[0], curcell[1] + 1}
+			}
+			curpos = [2]float64{curpos[0] + rayDirX*vermult, curpos[1] + ver}
+			textureIndex = curpos[0] - float64(curcell[0])
+		}
+		dist = dist + math.Sqrt(math.Min(horlen, verlen))
+		var realDist float64
+		if side == 0 {
+			realDist = (curpos[0] - player.X) / rayDirX
+		} else {
+			realDist = (curpos[1] - player.Y) / rayDirY
+		}
+
+		if curcell[0] < 0 || curcell[0] >= len(cells[0]) ||
+			curcell[1] < 0 || curcell[1] >= len(cells) {
+			return realDist, textureIndex, 1
+		}
+		if cells[curcell[1]][curcell[0]] != 0 {
+			return realDist, textureIndex, cells[curcell[1]][curcell[0]]
+		}
+	}
+}
+
 //Hit calculates if a player aims at another player
 func Hit(shootPlayer networking.Player, otherPlayer networking.Player, cells [][]uint8) bool {
 	relX := otherPlayer.X - shootPlayer.X
@@ -65,12 +142,34 @@ func Hit(shootPlayer networking.Player, otherPlayer networking.Player, cells [][
 	angleWidth := math.Atan((PlayerSize / 2) / dist)
 
 	dirX, dirY := game.Rotate(1, 0, shootPlayer.Angle)
-	wallDist, _, _ := graphics.Ray(shootPlayer, cells, dirX, dirY)
+	wallDist, _, _ := Ray(shootPlayer, cells, dirX, dirY)
 
 	return (shootPlayer.Angle > playerAngle-angleWidth || shootPlayer.Angle > playerAngle-angleWidth+math.Pi*2) &&
 		(shootPlayer.Angle < playerAngle+angleWidth || shootPlayer.Angle < playerAngle+angleWidth-math.Pi*2) && dist < wallDist
 }
 
+//Visible reports if any part of otherPlayer can be seen from player when looking towards it. Rays are cast to the
+//center and both edges of otherPlayer, so a player is visible as soon as it starts to come around a corner
+func Visible(player networking.Player, otherPlayer networking.Player, cells [][]uint8) bool {
+	relX := otherPlayer.X - player.X
+	relY := otherPlayer.Y - player.Y
+	dist := math.Sqrt(math.Pow(relX, 2) + math.Pow(relY, 2))
+	if dist == 0 {
+		return true
+	}
+
+	for _, offset := range []float64{0, PlayerSize / 2, -PlayerSize / 2} {
+		rayX := relX - relY/dist*offset
+		rayY := relY + relX/dist*offset
+		rayDist := math.Sqrt(math.Pow(rayX, 2) + math.Pow(rayY, 2))
+		wallDist, _, _ := Ray(player, cells, rayX/rayDist, rayY/rayDist)
+		if rayDist < wallDist {
+			return true
+		}
+	}
+	return false
+}
+
 //HandleInputs moves the player with the inputs
 func HandleInputs(player networking.Player, inputs []networking.Input, cells [][]uint8) networking.Player {
 	/*sort.SliceStable(inputs, func(i, j int) bool {
@@ -81,9 +180,10 @@ func HandleInputs(player networking.Player, inputs []networking.Input, cells [][
 		if i == 0 {
 			continue
 		}
-		delta := float64(input.TimeStamp - inputs[i-1].TimeStamp)
-		if delta < 0 {
-			delta += 60
+		//Inputs that are out of order or in the same tick do not move the player
+		delta := 0.0
+		if input.Tick > inputs[i-1].Tick {
+			delta = float64(input.Tick-inputs[i-1].Tick) / networking.TickRate
 		}
 
 		player.Angle += float64(input.MouseX) * 0.002
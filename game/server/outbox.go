@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oyberntzen/Raycasting-in-Golang/networking"
+)
+
+var (
+	//errBehind is returned by outbox.send when the client does not read as fast as packets are sent to it
+	errBehind = errors.New("client fell too far behind")
+	//errWriteFailed is returned by outbox.send after a write failed or took longer than writeTimeout
+	errWriteFailed = errors.New("could not write to client")
+	//errOutboxClosed is returned by outbox.send after close
+	errOutboxClosed = errors.New("connection is closed")
+)
+
+//outgoing is a packet waiting in an outbox
+type outgoing struct {
+	data interface{}
+	id   networking.PacketID
+}
+
+//outbox writes the packets for one connection on a goroutine of its own, so a client that reads slowly never
+//holds up the simulation. It is safe to use from several goroutines
+type outbox struct {
+	//bytesSent is Protocol.BytesSent after the last write. It is first so it is aligned for atomic
+	bytesSent uint64
+
+	conn    net.Conn
+	prot    *networking.Protocol
+	packets chan outgoing
+	//failed is closed when a write failed. The connection is closed then, so its reader notices too
+	failed chan struct{}
+	//done is closed when every packet is written and the connection is closed
+	done chan struct{}
+
+	lock   sync.Mutex
+	closed bool
+}
+
+//newOutbox starts the writer of the connection. It must be run by the simulation goroutine, since Stop waits
+//for the writers it started
+func (s *Server) newOutbox(conn net.Conn, prot *networking.Protocol) *outbox {
+	o := &outbox{
+		conn:    conn,
+		prot:    prot,
+		packets: make(chan outgoing, outboxSize),
+		failed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.closing.Add(1)
+	go func() {
+		defer s.closing.Done()
+		o.write()
+	}()
+	return o
+}
+
+//write sends the queued packets until close is called or a write fails, and then closes the connection
+func (o *outbox) write() {
+	defer close(o.done)
+	defer o.prot.Close()
+	for packet := range o.packets {
+		o.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := o.prot.Send(packet.data, packet.id); err != nil {
+			close(o.failed)
+			return
+		}
+		atomic.StoreUint64(&o.bytesSent, o.prot.BytesSent())
+	}
+}
+
+//sent returns how many bytes have been written so far. Unlike Protocol.BytesSent it never waits for a write
+func (o *outbox) sent() uint64 {
+	return atomic.LoadUint64(&o.bytesSent)
+}
+
+//send queues the packet without waiting for it to be written. An error is returned if an earlier write failed
+//or outboxSize packets are already waiting, so the caller can drop the client
+func (o *outbox) send(data interface{}, id networking.PacketID) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed {
+		return errOutboxClosed
+	}
+	select {
+	case <-o.failed:
+		return errWriteFailed
+	case o.packets <- outgoing{data, id}:
+		return nil
+	default:
+		return errBehind
+	}
+}
+
+//close writes a Disconnect after the packets already queued, unless reason is DisconnectQuit, and then closes
+//the connection. The Disconnect is left out if the client is too far behind to get it
+func (o *outbox) close(reason networking.DisconnectReason) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed {
+		return
+	}
+	if reason != networking.DisconnectQuit {
+		select {
+		case o.packets <- outgoing{networking.Disconnect{Reason: reason}, networking.DisconnectPacket}:
+		default:
+		}
+	}
+	o.closed = true
+	close(o.packets)
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/oyberntzen/Raycasting-in-Golang/networking"
+)
+
+var (
+	//errInputRate is returned by the input handlers when a client sends more than networking.MaxInputRate
+	errInputRate = errors.New("sent inputs too fast")
+	//errControlRate is returned by the Ping and SnapshotAck handlers when a client sends more than
+	//networking.MaxControlRate
+	errControlRate = errors.New("sent pings or acks too fast")
+)
+
+//violation reports if err means that the client broke the limits of the protocol and has to be disconnected
+func violation(err error) bool {
+	var size *networking.FrameSizeError
+	return errors.As(err, &size) || errors.Is(err, errInputRate) || errors.Is(err, errControlRate)
+}
+
+//playerConnection runs the handshake and then forwards what the client sends to the simulation goroutine
+func (s *Server) playerConnection(c net.Conn) {
+	var out *outbox
+	defer func() {
+		//The outbox closes the connection once it has written what was queued before the player was removed
+		if out != nil {
+			<-out.done
+		}
+		c.Close()
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+		s.connWait.Done()
+	}()
+	prot := networking.CreateProtocol(c)
+	if s.config.Recorder != nil {
+		s.config.Recorder.Record(prot)
+	}
+
+	c.SetReadDeadline(time.Now().Add(networking.HandshakeTimeout))
+	playerInfo, err := prot.RecieveHandshake()
+	if err != nil {
+		s.logf("Handshake with %v failed: %v", c.RemoteAddr(), err)
+		return
+	}
+
+	var id uint16
+	var lastTick uint64
+	joined := false
+	if !s.do(func() {
+		id, out, joined = s.join(c, prot, playerInfo)
+		lastTick = s.clock.Tick()
+	}) {
+		prot.Disconnect(networking.DisconnectServerShutdown, "")
+		return
+	}
+	if !joined {
+		return
+	}
+	spectator := prot.Features.Has(networking.FeatureSpectator)
+
+	dispatcher := networking.NewDispatcher()
+	//Inputs are sent several times until the server acknowledges them, so only numbers from nextInput are new.
+	//Ticks never go back from lastTick, which starts at the tick the connection joined or resumed on
+	var nextInput uint64
+	inputRate := networking.NewRateLimiter(networking.MaxInputRate, networking.MaxInputBurst)
+	handleInputs := func(inputs []networking.Input) error {
+		if !inputRate.Allow(time.Now()) {
+			return errInputRate
+		}
+		fresh := make([]networking.Input, 0, len(inputs))
+		for _, input := range inputs {
+			if input.Number < nextInput {
+				continue
+			}
+			nextInput = input.Number + 1
+			//A client can not move faster by sending ticks from the future, or by going back and moving through
+			//the same ticks again
+			if max := s.clock.Tick() + maxInputLead; input.Tick > max {
+				input.Tick = max
+			}
+			if input.Tick < lastTick {
+				input.Tick = lastTick
+			}
+			lastTick = input.Tick
+			fresh = append(fresh, input)
+		}
+		if len(fresh) == 0 {
+			return nil
+		}
+		s.do(func() {
+			if client := s.connection(id, prot); client != nil {
+				client.addInputs(fresh)
+			}
+		})
+		return nil
+	}
+	//Inputs of spectators are counted as unknown packets
+	if !spectator {
+		dispatcher.OnInput(func(input networking.Input) error {
+			return handleInputs([]networking.Input{input})
+		})
+		dispatcher.OnInputs(func(inputs networking.Inputs) error {
+			return handleInputs(inputs.Inputs)
+		})
+	}
+	//Every ack is handled on the simulation goroutine and every ping queues a Pong, so they are limited too
+	controlRate := networking.NewRateLimiter(networking.MaxControlRate, networking.MaxControlBurst)
+	dispatcher.OnPing(func(ping networking.Ping) error {
+		if !controlRate.Allow(time.Now()) {
+			return errControlRate
+		}
+		return out.send(s.clock.Pong(ping), networking.PongPacket)
+	})
+	dispatcher.OnSnapshotAck(func(ack networking.SnapshotAck) error {
+		now := time.Now()
+		if !controlRate.Allow(now) {
+			return errControlRate
+		}
+		s.do(func() {
+			client := s.connection(id, prot)
+			if client == nil {
+				return
+			}
+			//Acks are unreliable and may arrive out of order
+			if !client.acked || ack.Frame > client.ack {
+				client.ack, client.acked = ack.Frame, true
+			}
+			client.rate.Acked(ack.Frame, now)
+		})
+		return nil
+	})
+	dispatcher.OnDisconnect(func(disconnect networking.Disconnect) error {
+		return &networking.DisconnectError{Reason: disconnect.Reason, Message: disconnect.Message}
+	})
+
+	for {
+		//Handle message from client
+		c.SetReadDeadline(time.Now().Add(networking.IdleTimeout))
+		pid, data, err := prot.Recieve()
+		if violation(err) {
+			s.logf("Player %d: %v", id, err)
+			s.removeConnection(id, prot, networking.DisconnectViolation)
+			break
+		}
+		if err != nil {
+			if networking.IsTimeout(err) {
+				s.logf("Player %d sent nothing for %v", id, networking.IdleTimeout)
+			}
+			//The connection dropped without a Disconnect, so the player can resume
+			s.removeConnection(id, prot, networking.DisconnectTimeout)
+			break
+		}
+
+		if err := dispatcher.Dispatch(pid, data); err != nil {
+			var disconnect *networking.DisconnectError
+			if errors.As(err, &disconnect) {
+				s.removeConnection(id, prot, disconnect.Reason)
+				break
+			}
+			s.logf("Player %d: %v", id, err)
+			if violation(err) {
+				s.removeConnection(id, prot, networking.DisconnectViolation)
+				break
+			}
+		}
+	}
+
+	if unknown := dispatcher.Unknown(); len(unknown) > 0 {
+		s.logf("Player %d sent packets with unknown PacketIDs: %v", id, unknown)
+	}
+}
+
+//connection returns the player id or the spectator on prot. nil is returned if prot is no longer the connection
+//of the player, since it may have resumed on a new connection or already been dropped
+func (s *Server) connection(id uint16, prot *networking.Protocol) *client {
+	if c, ok := s.spectators[prot]; ok {
+		return c
+	}
+	if c, ok := s.clients[id]; ok && c.prot == prot {
+		return c
+	}
+	return nil
+}
+
+//removeConnection drops the player or spectator from a connection goroutine, see connection
+func (s *Server) removeConnection(id uint16, prot *networking.Protocol, reason networking.DisconnectReason) {
+	removed := false
+	s.do(func() {
+		if _, ok := s.spectators[prot]; ok {
+			s.unwatch(prot, reason)
+			removed = true
+		} else if s.connection(id, prot) != nil {
+			s.drop(id, reason)
+			removed = true
+		}
+	})
+	if !removed {
+		prot.Close()
+	}
+}
+
+//authenticate returns why the player can not join, or an empty string if it can
+func (s *Server) authenticate(info networking.PlayerInfo) (networking.DisconnectReason, string) {
+	if s.config.Credentials == nil {
+		return 0, ""
+	}
+	if !s.config.Credentials.Check(info.Username, info.Token) {
+		return networking.DisconnectRejected, "invalid username or token"
+	}
+	//Spectators may watch with the name of a player
+	if info.Features.Has(networking.FeatureSpectator) {
+		return 0, ""
+	}
+	for _, c := range s.clients {
+		if c.name == info.Username {
+			return networking.DisconnectRejected, info.Username + " is already connected"
+		}
+	}
+	return 0, ""
+}
+
+//join accepts the handshake of a player and adds it to the game, or adds a spectator if it asked for
+//FeatureSpectator. The returned outbox sends everything to the client, also the rejection if join returns false
+func (s *Server) join(conn net.Conn, prot *networking.Protocol, playerInfo networking.PlayerInfo) (uint16, *outbox, bool) {
+	out := s.newOutbox(conn, prot)
+	addr := conn.RemoteAddr()
+	if playerInfo.Features.Has(networking.FeatureSpectator) {
+		return 0, out, s.watch(out, playerInfo, addr)
+	}
+	//A client may reconnect before the server notices that the old connection dropped
+	if playerInfo.SessionToken != "" {
+		for oldID, c := range s.clients {
+			if c.token == playerInfo.SessionToken && c.name == playerInfo.Username {
+				s.drop(oldID, networking.DisconnectTimeout)
+				break
+			}
+		}
+	}
+	if code, reason := s.authenticate(playerInfo); reason != "" {
+		s.logf("Rejected %s from %v: %s", playerInfo.Username, addr, reason)
+		s.reject(out, code, reason)
+		return 0, out, false
+	}
+
+	//A resumed player keeps its PlayerID, so it already has a slot
+	var thisPlayer networking.Player
+	token := playerInfo.SessionToken
+	session, resumed := s.sessions.Resume(token, playerInfo.Username)
+	if resumed {
+		//Input numbers start over on the new connection
+		thisPlayer = session.Player
+		thisPlayer.LastInputNumber = 0
+		thisPlayer.LastInputs = nil
+	} else {
+		id, ok := s.playerIDs.Allocate()
+		if !ok {
+			s.logf("Rejected %s from %v: server is full", playerInfo.Username, addr)
+			s.reject(out, networking.DisconnectServerFull, fmt.Sprintf("server is full (%d players)", s.playerIDs.Max))
+			return 0, out, false
+		}
+		var err error
+		if token, err = networking.NewSessionToken(); err != nil {
+			s.logf("Could not create session for %v: %v", addr, err)
+			s.playerIDs.Release(id)
+			out.close(networking.DisconnectQuit)
+			return 0, out, false
+		}
+		thisPlayer = s.spawnPlayer(id)
+	}
+	id := thisPlayer.PlayerID
+
+	rate := networking.NewSnapshotRate(float64(playerInfo.SnapshotRate), float64(s.config.StepRate))
+	reply := networking.HandshakeReply{SnapshotRate: uint8(rate.Rate()), SessionToken: token}
+	out.send(prot.AcceptReply(playerInfo, reply), networking.HandshakeReplyPacket)
+	out.send(networking.ServerInfo{ThisPlayer: thisPlayer, Cells: s.level.Cells, Sprites: s.level.Sprites}, networking.ServerInfoPacket)
+	if resumed {
+		s.logf("%s resumed as player %d", playerInfo.Username, id)
+	} else {
+		s.logf("%s joined as player %d", playerInfo.Username, id)
+	}
+
+	for otherID, c := range s.clients {
+		s.sendEvent(id, networking.Event{Event: networking.JoinEvent, PlayerID: otherID, Name: c.name})
+	}
+	s.players[id] = thisPlayer
+	s.clients[id] = &client{
+		name:     playerInfo.Username,
+		token:    token,
+		prot:     prot,
+		out:      out,
+		inputs:   []networking.Input{{Tick: s.clock.Tick()}},
+		history:  &networking.SnapshotHistory{},
+		interest: make(map[uint16]uint64),
+		rate:     rate,
+	}
+	//The other players were never told that a resumed player left
+	if !resumed {
+		s.broadcastEvent(networking.Event{Event: networking.JoinEvent, PlayerID: id, Name: playerInfo.Username}, id)
+	}
+	return id, out, true
+}
+
+//reject tells the client why it can not join and closes the connection
+func (s *Server) reject(out *outbox, code networking.DisconnectReason, reason string) {
+	out.send(networking.RejectReply(code, reason), networking.HandshakeReplyPacket)
+	//The reply already has the reason, so no Disconnect follows it
+	out.close(networking.DisconnectQuit)
+}
+
+//drop removes the player and tells the other players why it left. A player that timed out is kept in sessions
+//instead, and the others are only told if it does not come back. Unless the player quit by itself it is sent a
+//Disconnect before the connection is closed, without blocking the simulation
+func (s *Server) drop(id uint16, reason networking.DisconnectReason) {
+	c, ok := s.clients[id]
+	if !ok {
+		return
+	}
+	if reason == networking.DisconnectTimeout && s.sessions.Suspend(c.token, c.name, s.players[id]) {
+		s.logf("%s lost connection, keeping player %d for %v", c.name, id, s.sessions.Grace)
+	} else {
+		s.logf("%s left: %v", c.name, reason)
+		s.broadcastEvent(networking.Event{Event: networking.LeaveEvent, PlayerID: id, Name: c.name, Reason: reason}, id)
+		s.playerIDs.Release(id)
+	}
+	delete(s.players, id)
+	delete(s.clients, id)
+	for _, other := range s.clients {
+		delete(other.interest, id)
+	}
+	c.out.close(reason)
+}
+
+//watch accepts the handshake of a spectator. It gets no PlayerID, so it does not count against Config.MaxPlayers
+func (s *Server) watch(out *outbox, playerInfo networking.PlayerInfo, addr net.Addr) bool {
+	if code, reason := s.authenticate(playerInfo); reason != "" {
+		s.logf("Rejected spectator %s from %v: %s", playerInfo.Username, addr, reason)
+		s.reject(out, code, reason)
+		return false
+	}
+
+	rate := networking.NewSnapshotRate(float64(playerInfo.SnapshotRate), float64(s.config.StepRate))
+	out.send(out.prot.AcceptReply(playerInfo, networking.HandshakeReply{SnapshotRate: uint8(rate.Rate())}), networking.HandshakeReplyPacket)
+	out.send(networking.ServerInfo{Cells: s.level.Cells, Sprites: s.level.Sprites}, networking.ServerInfoPacket)
+	s.logf("%s is watching", playerInfo.Username)
+
+	for id, c := range s.clients {
+		if err := out.send(networking.Event{Event: networking.JoinEvent, PlayerID: id, Name: c.name}, networking.EventPacket); err != nil {
+			out.close(networking.DisconnectTimeout)
+			return false
+		}
+	}
+	s.spectators[out.prot] = &client{
+		name:     playerInfo.Username,
+		prot:     out.prot,
+		out:      out,
+		history:  &networking.SnapshotHistory{},
+		interest: make(map[uint16]uint64),
+		rate:     rate,
+	}
+	return true
+}
+
+//unwatch removes a spectator
+func (s *Server) unwatch(prot *networking.Protocol, reason networking.DisconnectReason) {
+	c, ok := s.spectators[prot]
+	if !ok {
+		return
+	}
+	s.logf("%s stopped watching: %v", c.name, reason)
+	delete(s.spectators, prot)
+	c.out.close(reason)
+}
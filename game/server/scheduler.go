@@ -0,0 +1,54 @@
+package server
+
+import "time"
+
+//overrunReportInterval is how often the simulation goroutine logs the steps that overran
+const overrunReportInterval = 10 * time.Second
+
+//scheduler decides when simulation steps run. Steps are due at fixed times from the start instead of a fixed time
+//after the last step, so time spent in steps and late wakeups do not add up to drift
+type scheduler struct {
+	step  time.Duration
+	start time.Time
+	//steps is the number of steps that have been scheduled since start
+	steps int64
+
+	//overruns counts the steps that ended after the next step was due, skipped the steps that were dropped to catch up
+	overruns, skipped int64
+	lastReport        time.Time
+}
+
+func newScheduler(step time.Duration, start time.Time) *scheduler {
+	return &scheduler{step: step, start: start, steps: 1, lastReport: start}
+}
+
+//next returns when the next step is due
+func (sc *scheduler) next() time.Time {
+	return sc.start.Add(time.Duration(sc.steps) * sc.step)
+}
+
+//finished schedules the step after the one that ended at now. If the simulation is more than a whole step behind,
+//the missed steps are skipped so it does not run them back to back
+func (sc *scheduler) finished(now time.Time) {
+	sc.steps++
+	late := now.Sub(sc.next())
+	if late <= 0 {
+		return
+	}
+	sc.overruns++
+	if missed := int64(late / sc.step); missed > 0 {
+		sc.steps += missed
+		sc.skipped += missed
+	}
+}
+
+//report returns the overruns and skipped steps since the last report, at most once per overrunReportInterval.
+//ok is false if there is nothing to report
+func (sc *scheduler) report(now time.Time) (overruns, skipped int64, ok bool) {
+	if sc.overruns == 0 || now.Sub(sc.lastReport) < overrunReportInterval {
+		return 0, 0, false
+	}
+	overruns, skipped = sc.overruns, sc.skipped
+	sc.overruns, sc.skipped, sc.lastReport = 0, 0, now
+	return overruns, skipped, true
+}
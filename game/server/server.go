@@ -0,0 +1,516 @@
+//Package server runs the game for the players connected over networking. A Server owns all of its state, so
+//several servers can run in one process, such as in tests
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oyberntzen/Raycasting-in-Golang/game/levels"
+	"github.com/oyberntzen/Raycasting-in-Golang/game/physics"
+	"github.com/oyberntzen/Raycasting-in-Golang/networking"
+)
+
+const (
+	//DefaultStepRate is the number of simulation steps per second when Config.StepRate is 0
+	DefaultStepRate = 20
+	//MaxStepRate is the highest Config.StepRate, since snapshot rates are sent as an Uint8
+	MaxStepRate = 255
+	//DefaultTickRate is the old name of DefaultStepRate.
+	//
+	//Deprecated: Use DefaultStepRate.
+	DefaultTickRate = DefaultStepRate
+	//MaxTickRate is the old name of MaxStepRate.
+	//
+	//Deprecated: Use MaxStepRate.
+	MaxTickRate = MaxStepRate
+	//DefaultMode is the game mode when Config.Mode is empty
+	DefaultMode = "deathmatch"
+
+	//inputLogTicks is how long the inputs of a player are kept, so clients with a low snapshot rate can replay them
+	inputLogTicks = networking.TickRate
+
+	maxHealth uint8 = 100
+
+	//pickupHealth is how much health a pickup gives, up to maxHealth
+	pickupHealth uint8 = 25
+	//pickupRadius is how close a player must be to take a pickup
+	pickupRadius = 0.5
+	//pickupRespawnTicks is how long a pickup is gone after it is taken
+	pickupRespawnTicks = 15 * networking.TickRate
+	//maxInputLead is how many ticks ahead of the server clock an input can be
+	maxInputLead = networking.TickRate / 2
+
+	//hearingRadius is the distance other players are sent from even when they are behind walls
+	hearingRadius = 4.0
+	//interestGrace is how many ticks a player is still sent after it was last visible or heard
+	interestGrace = networking.TickRate / 2
+
+	//outboxSize is how many packets can wait to be written to a client before it is dropped
+	outboxSize = 256
+	//writeTimeout is how long writing one packet to a client can take before it is dropped
+	writeTimeout = 2 * time.Second
+)
+
+//ErrStopped is returned by Serve when the server has been stopped
+var ErrStopped = errors.New("server is stopped")
+
+//gameMode is a set of rules chosen with Config.Mode
+type gameMode struct {
+	//shotDamage is how much health a hit takes. Shots do not hurt when it is 0
+	shotDamage uint8
+	//pickups tells if the health pickups of the levels are spawned
+	pickups bool
+}
+
+var gameModes = map[string]gameMode{
+	"deathmatch": {shotDamage: 10, pickups: true},
+	"instagib":   {shotDamage: maxHealth},
+	"explore":    {},
+}
+
+//GameModes returns the names Config.Mode can be set to in sorted order
+func GameModes() []string {
+	names := make([]string, 0, len(gameModes))
+	for name := range gameModes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Config is how a Server is set up. Fields left at their zero value get a default
+type Config struct {
+	//Name is shown in the server list of clients on the LAN
+	Name string
+	//Port is where players connect. It is only used to tell clients on the LAN
+	Port int
+	//Levels are played in turn, starting with the first. Every level in levels.Levels is played if it is empty
+	Levels []levels.Level
+	//LevelTime is how long a level is played before the next, 0 to only change with NextLevel
+	LevelTime time.Duration
+	//Mode is one of GameModes, DefaultMode if empty
+	Mode string
+	//StepRate is the number of simulation steps per second, from 1 to MaxStepRate. Clients get at most this many
+	//snapshots per second. It is not networking.TickRate, the ticks inputs and snapshots are timed in
+	StepRate int
+	//TickRate is the old name of StepRate and only used when StepRate is 0.
+	//
+	//Deprecated: Use StepRate.
+	TickRate int
+	//MaxPlayers is how many players can be connected or waiting to reconnect at a time, see networking.NewPlayerIDs
+	MaxPlayers int
+	//SessionGrace is how long a dropped player is kept so it can reconnect, 0 to remove it at once
+	SessionGrace time.Duration
+	//Credentials are checked in the handshake if set
+	Credentials networking.Credentials
+	//Recorder captures every connection if set. The server does not close it
+	Recorder *networking.Recorder
+	//Logger gets the messages of the server. The standard logger is used if it is nil
+	Logger *log.Logger
+}
+
+//Server is a game server. Only the simulation goroutine started by Start touches the game state. Connection
+//goroutines send it requests, so no state is shared between goroutines
+type Server struct {
+	config Config
+	mode   gameMode
+	step   time.Duration
+	//stepTicks is how many ticks of networking.TickRate a step takes
+	stepTicks uint64
+	clock     *networking.Clock
+	sessions  *networking.Sessions
+	playerIDs *networking.PlayerIDs
+
+	//requests are run by the simulation goroutine, see do
+	requests chan func()
+	stop     chan struct{}
+	done     chan struct{}
+	//closing waits for the outboxes to write what is queued, such as the Disconnects from Stop
+	closing sync.WaitGroup
+
+	//lock protects the lifecycle and the listeners and connections that Stop closes
+	lock             sync.Mutex
+	started, stopped bool
+	listeners        map[net.Listener]bool
+	conns            map[net.Conn]bool
+	connWait         sync.WaitGroup
+
+	//Everything below is owned by the simulation goroutine
+	level          levels.Level
+	levelIndex     int
+	levelStart     time.Time
+	entities       map[uint32]networking.Entity
+	entityRespawns map[uint32]uint64
+	nextEntityID   uint32
+	frame          uint64
+	players        map[uint16]networking.Player
+	clients        map[uint16]*client
+	//spectators watch with FeatureSpectator and have no player
+	spectators map[*networking.Protocol]*client
+	events     []queuedEvent
+}
+
+//client is the connection of a player and what has been sent on it. It is owned by the simulation goroutine
+type client struct {
+	name, token string
+	prot        *networking.Protocol
+	//out is where everything for the client is sent, so the simulation never waits for the network
+	out *outbox
+
+	//inputs are the inputs recieved since the last step, starting with the last input of the step before
+	inputs []networking.Input
+	//inputLog is the inputs of the last inputLogTicks, see logInputs
+	inputLog []networking.Input
+	//overdue is set while the player is moved without its inputs. base is where its last input left it
+	overdue bool
+	base    networking.Player
+
+	ack       uint64
+	acked     bool
+	history   *networking.SnapshotHistory
+	interest  map[uint16]uint64
+	rate      *networking.SnapshotRate
+	sentFrame uint64
+}
+
+//New creates a server. Call Start to run it and Serve to accept players
+func New(config Config) (*Server, error) {
+	if len(config.Levels) == 0 {
+		config.Levels = levels.Levels
+	}
+	if config.Mode == "" {
+		config.Mode = DefaultMode
+	}
+	mode, ok := gameModes[config.Mode]
+	if !ok {
+		return nil, fmt.Errorf("unknown game mode %q", config.Mode)
+	}
+	if config.StepRate == 0 {
+		config.StepRate = config.TickRate
+	}
+	if config.StepRate == 0 {
+		config.StepRate = DefaultStepRate
+	}
+	if config.StepRate < 1 || config.StepRate > MaxStepRate {
+		return nil, fmt.Errorf("step rate must be from 1 to %d", MaxStepRate)
+	}
+
+	s := &Server{
+		config:    config,
+		mode:      mode,
+		step:      time.Second / time.Duration(config.StepRate),
+		clock:     networking.NewClock(),
+		sessions:  networking.NewSessions(config.SessionGrace),
+		playerIDs: networking.NewPlayerIDs(config.MaxPlayers),
+
+		requests: make(chan func()),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+
+		players:    make(map[uint16]networking.Player),
+		clients:    make(map[uint16]*client),
+		spectators: make(map[*networking.Protocol]*client),
+	}
+	s.stepTicks = uint64(s.step * networking.TickRate / time.Second)
+	s.loadLevel(config.Levels[0])
+	return s, nil
+}
+
+//Start starts the simulation goroutine
+func (s *Server) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started || s.stopped {
+		return
+	}
+	s.started = true
+	s.logf("Playing %s on %s with %d steps per second", s.config.Mode, s.level.Name, s.config.StepRate)
+	go s.run()
+}
+
+//Stop stops accepting players, tells every player that the server shuts down and waits until the connections
+//are closed
+func (s *Server) Stop() {
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		<-s.done
+		return
+	}
+	s.stopped = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	started := s.started
+	s.lock.Unlock()
+
+	if started {
+		close(s.stop)
+	} else {
+		close(s.done)
+	}
+	<-s.done
+	s.closing.Wait()
+
+	//Connections still in the handshake are not known by the simulation
+	s.lock.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.lock.Unlock()
+	s.connWait.Wait()
+}
+
+//Serve accepts players from l until Stop is called, which also closes l. It returns nil after Stop, otherwise
+//the error from Accept
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		l.Close()
+		return ErrStopped
+	}
+	s.listeners[l] = true
+	s.lock.Unlock()
+
+	for {
+		c, err := l.Accept()
+		s.lock.Lock()
+		stopped := s.stopped
+		if err != nil || stopped {
+			delete(s.listeners, l)
+			s.lock.Unlock()
+			if c != nil {
+				c.Close()
+			}
+			if stopped {
+				return nil
+			}
+			return err
+		}
+		s.conns[c] = true
+		s.connWait.Add(1)
+		s.lock.Unlock()
+
+		go s.playerConnection(c)
+	}
+}
+
+//NextLevel changes to the next level at once
+func (s *Server) NextLevel() {
+	s.do(func() {
+		s.nextLevel(time.Now())
+	})
+}
+
+//Announcement is what the server tells clients looking for servers on the LAN
+func (s *Server) Announcement() networking.ServerAnnouncement {
+	announcement := networking.ServerAnnouncement{
+		Version:    networking.ProtocolVersion,
+		Name:       s.config.Name,
+		MaxPlayers: s.playerIDs.Max,
+		Port:       s.config.Port,
+	}
+	s.do(func() {
+		announcement.Level = s.level.Name
+		announcement.Players = len(s.players)
+	})
+	return announcement
+}
+
+//View returns the cells of the level and every player, for observers such as the window of the server. Nothing
+//is returned after Stop
+func (s *Server) View() ([][]uint8, []networking.Player) {
+	var cells [][]uint8
+	players := []networking.Player{}
+	s.do(func() {
+		cells = s.level.Cells
+		for _, player := range s.players {
+			players = append(players, player)
+		}
+	})
+	return cells, players
+}
+
+//do runs f on the simulation goroutine and waits until it has run. It returns false without running f if the
+//server is stopped. It must never be called from the simulation goroutine
+func (s *Server) do(f func()) bool {
+	finished := make(chan struct{})
+	select {
+	case s.requests <- func() {
+		f()
+		close(finished)
+	}:
+	case <-s.done:
+		return false
+	}
+	<-finished
+	return true
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.config.Logger != nil {
+		s.config.Logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+//run is the simulation goroutine. It runs a step at the step rate and the requests in between
+func (s *Server) run() {
+	defer close(s.done)
+	s.levelStart = time.Now()
+	schedule := newScheduler(s.step, s.levelStart)
+	timer := time.NewTimer(time.Until(schedule.next()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case request := <-s.requests:
+			request()
+		case <-timer.C:
+			s.update(time.Now())
+			now := time.Now()
+			schedule.finished(now)
+			if overruns, skipped, ok := schedule.report(now); ok {
+				s.logf("Simulation is falling behind: %d steps took longer than %v, %d steps were skipped", overruns, s.step, skipped)
+			}
+			timer.Reset(time.Until(schedule.next()))
+		case <-s.stop:
+			for id := range s.clients {
+				s.drop(id, networking.DisconnectServerShutdown)
+			}
+			for prot := range s.spectators {
+				s.unwatch(prot, networking.DisconnectServerShutdown)
+			}
+			return
+		}
+	}
+}
+
+//stepped returns the player as its last input left it, without the movement made while its inputs were overdue
+func (s *Server) stepped(id uint16) networking.Player {
+	player := s.players[id]
+	if c := s.clients[id]; c != nil && c.overdue {
+		player.X, player.Y, player.Z, player.Vel = c.base.X, c.base.Y, c.base.Z, c.base.Vel
+	}
+	return player
+}
+
+//update runs one simulation step and sends the snapshots that are due. Every player and entity is stepped, even
+//without new inputs
+func (s *Server) update(now time.Time) {
+	if s.config.LevelTime > 0 && now.Sub(s.levelStart) >= s.config.LevelTime {
+		s.nextLevel(now)
+	}
+
+	for _, session := range s.sessions.Expire(now) {
+		s.logf("%s did not reconnect in time", session.Name)
+		s.broadcastEvent(networking.Event{Event: networking.LeaveEvent, PlayerID: session.Player.PlayerID, Name: session.Name, Reason: networking.DisconnectTimeout})
+		s.playerIDs.Release(session.Player.PlayerID)
+	}
+
+	tick := s.clock.Tick()
+	s.handleShots()
+	for id, c := range s.clients {
+		inputs := c.inputs
+		if len(inputs) == 0 {
+			continue
+		}
+		c.inputs = []networking.Input{inputs[len(inputs)-1]}
+		//Late inputs move the player from where its last input left it, not from where it was moved without them
+		player := s.stepped(id)
+		c.overdue = false
+
+		for i := 1; i < len(inputs); i++ {
+			onGround := player.Z <= 0
+			player = physics.HandleInputs(player, inputs[i-1:i+1], s.level.Cells)
+			if inputs[i].Jump && onGround {
+				s.nearbyEvent(networking.Event{Event: networking.JumpEvent, PlayerID: id})
+			}
+		}
+		player.LastInputNumber = inputs[len(inputs)-1].Number
+		player.LastInputs = inputs
+		c.logInputs(inputs[1:], inputs[len(inputs)-1].Tick)
+
+		//A player whose inputs are more than a step overdue is moved on as if no key was held, so it still falls.
+		//This is undone when the inputs arrive
+		if last := inputs[len(inputs)-1]; tick > last.Tick+s.stepTicks {
+			c.base, c.overdue = player, true
+			player = physics.HandleInputs(player, []networking.Input{last, {Number: last.Number, Tick: tick}}, s.level.Cells)
+		}
+		s.players[id] = player
+	}
+
+	s.updateEntities(tick)
+	worldEntities := s.entityList()
+
+	failed, failedSpectators := s.sendEvents(tick)
+	for id, c := range s.clients {
+		if failed[id] {
+			continue
+		}
+		//The simulation keeps running for clients that get fewer snapshots
+		if !c.rate.Due(now) {
+			continue
+		}
+
+		snapshot := networking.Snapshot{}
+		//The client corrects its prediction from the state right after its last input
+		snapshot.ThisPlayer = s.stepped(id)
+		//The client predicts its own movement and never uses its own inputs
+		snapshot.ThisPlayer.LastInputs = nil
+		snapshot.OtherPlayers = []networking.Player{}
+		snapshot.Frame = s.frame
+		snapshot.Tick = tick
+		snapshot.Entities = worldEntities
+
+		for otherID, otherPlayer := range s.players {
+			if otherID != id && s.interested(id, otherPlayer, tick) {
+				otherPlayer.LastInputs = s.inputsSinceSnapshot(c, otherPlayer)
+				snapshot.OtherPlayers = append(snapshot.OtherPlayers, otherPlayer)
+			}
+		}
+
+		if err := c.sendSnapshot(snapshot); err != nil {
+			failed[id] = true
+			continue
+		}
+		c.rate.Sent(s.frame, now, c.out.sent())
+		c.sentFrame = s.frame
+	}
+
+	for prot, c := range s.spectators {
+		if failedSpectators[prot] || !c.rate.Due(now) {
+			continue
+		}
+		snapshot := networking.Snapshot{Frame: s.frame, Tick: tick, OtherPlayers: []networking.Player{}, Entities: worldEntities}
+		for _, player := range s.players {
+			player.LastInputs = s.inputsSinceSnapshot(c, player)
+			snapshot.OtherPlayers = append(snapshot.OtherPlayers, player)
+		}
+		if err := c.sendSnapshot(snapshot); err != nil {
+			failedSpectators[prot] = true
+			continue
+		}
+		c.rate.Sent(s.frame, now, c.out.sent())
+		c.sentFrame = s.frame
+	}
+
+	for id := range failed {
+		s.drop(id, networking.DisconnectTimeout)
+	}
+	for prot := range failedSpectators {
+		s.unwatch(prot, networking.DisconnectTimeout)
+	}
+	s.frame++
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/oyberntzen/Raycasting-in-Golang/game/physics"
+	"github.com/oyberntzen/Raycasting-in-Golang/networking"
+)
+
+//startServer runs a server on a memory transport until the test ends
+func startServer(t *testing.T, config Config) (*Server, *networking.MemoryTransport) {
+	if config.Logger == nil {
+		config.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	s, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := networking.NewMemoryTransport()
+	l, err := transport.Listen("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Start()
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+	return s, transport
+}
+
+//testClient is a connection to a test server
+type testClient struct {
+	*networking.Protocol
+	conn net.Conn
+}
+
+//connect does the handshake and returns the connection and the ServerInfo
+func connect(t *testing.T, transport *networking.MemoryTransport, info networking.PlayerInfo) (*testClient, networking.ServerInfo) {
+	conn, err := transport.Dial("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{Protocol: networking.CreateProtocol(conn), conn: conn}
+	t.Cleanup(func() { c.Close() })
+	if _, err := c.SendHandshake(info); err != nil {
+		t.Fatal(err)
+	}
+	serverInfo, err := c.recieve(networking.ServerInfoPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, serverInfo.(networking.ServerInfo)
+}
+
+//recieve returns the next packet with the id and skips the others
+func (c *testClient) recieve(want networking.PacketID) (interface{}, error) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		id, data, err := c.Recieve()
+		if err != nil {
+			return nil, err
+		}
+		if id == want {
+			return networking.DecodePacket(id, data)
+		}
+	}
+}
+
+func TestSpectator(t *testing.T) {
+	_, transport := startServer(t, Config{MaxPlayers: 1})
+
+	spectator, info := connect(t, transport, networking.PlayerInfo{Username: "dashboard", Features: networking.FeatureSpectator})
+	if len(info.Cells) == 0 {
+		t.Error("spectator got no level")
+	}
+
+	//The spectator does not take the only player slot
+	player, info := connect(t, transport, networking.PlayerInfo{Username: "player"})
+	id := info.ThisPlayer.PlayerID
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		packet, err := spectator.recieve(networking.SnapshotPacket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot := packet.(networking.Snapshot)
+		if snapshot.ThisPlayer.PlayerID != 0 {
+			t.Fatalf("spectator was sent player %d as its own", snapshot.ThisPlayer.PlayerID)
+		}
+		if len(snapshot.OtherPlayers) == 1 && snapshot.OtherPlayers[0].PlayerID == id {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("spectator was never sent the player")
+		}
+	}
+
+	//Players are not sent the spectator, and its inputs move nobody
+	spectator.Send(networking.Input{Tick: 1, Up: true}, networking.InputPacket)
+	packet, err := player.recieve(networking.SnapshotPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if others := packet.(networking.Snapshot).OtherPlayers; len(others) != 0 {
+		t.Errorf("player was sent %d other players", len(others))
+	}
+}
+
+func TestInputTicksGoForward(t *testing.T) {
+	s, transport := startServer(t, Config{})
+	player, info := connect(t, transport, networking.PlayerInfo{Username: "player"})
+	id := info.ThisPlayer.PlayerID
+
+	//Going back and forth between two ticks would move the player through the same ticks again and again
+	var start uint64
+	s.do(func() { start = s.clock.Tick() })
+	inputs := networking.Inputs{}
+	for i := 1; i <= 6; i++ {
+		tick := start
+		if i%2 == 0 {
+			tick += maxInputLead / 2
+		}
+		inputs.Inputs = append(inputs.Inputs, networking.Input{Number: uint64(i), Tick: tick, Up: true})
+	}
+	if err := player.Send(inputs, networking.InputsPacket); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged []networking.Input
+	deadline := time.Now().Add(5 * time.Second)
+	for len(logged) == 0 || logged[len(logged)-1].Number < 6 {
+		if time.Now().After(deadline) {
+			t.Fatalf("inputs were never stepped, got %+v", logged)
+		}
+		time.Sleep(10 * time.Millisecond)
+		s.do(func() { logged = append([]networking.Input{}, s.clients[id].inputLog...) })
+	}
+	for i := 1; i < len(logged); i++ {
+		if logged[i].Tick < logged[i-1].Tick {
+			t.Fatalf("input %d went back from tick %d to %d", logged[i].Number, logged[i-1].Tick, logged[i].Tick)
+		}
+	}
+	if last := logged[len(logged)-1].Tick; last > start+maxInputLead/2 {
+		t.Errorf("inputs reached tick %d, want at most %d", last, start+maxInputLead/2)
+	}
+}
+
+func TestStalledClient(t *testing.T) {
+	s, transport := startServer(t, Config{})
+
+	//Writes to a pipe block until the other end reads, like a client that stopped reading its socket
+	conn, serverConn := net.Pipe()
+	s.lock.Lock()
+	s.conns[serverConn] = true
+	s.connWait.Add(1)
+	s.lock.Unlock()
+	go s.playerConnection(serverConn)
+	stalled := &testClient{Protocol: networking.CreateProtocol(conn), conn: conn}
+	t.Cleanup(func() { stalled.Close() })
+	if _, err := stalled.SendHandshake(networking.PlayerInfo{Username: "stalled"}); err != nil {
+		t.Fatal(err)
+	}
+
+	//The other player still gets snapshots while nothing is read from the stalled client
+	player, _ := connect(t, transport, networking.PlayerInfo{Username: "player"})
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		if _, err := player.recieve(networking.SnapshotPacket); err != nil {
+			t.Fatal(err)
+		}
+		if waited := time.Since(start); waited > writeTimeout/2 {
+			t.Fatalf("waited %v for a snapshot", waited)
+		}
+	}
+
+	//The stalled client is dropped after writeTimeout
+	deadline := time.Now().Add(2*writeTimeout + 5*time.Second)
+	for {
+		players := 0
+		s.do(func() { players = len(s.clients) })
+		if players == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stalled client was never dropped")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestLateInputs(t *testing.T) {
+	s, transport := startServer(t, Config{})
+	player, info := connect(t, transport, networking.PlayerInfo{Username: "player"})
+	id := info.ThisPlayer.PlayerID
+
+	//Nothing is sent for a few steps, so the player is moved on without inputs
+	var first networking.Input
+	var start networking.Player
+	s.do(func() { first, start = s.clients[id].inputs[0], s.stepped(id) })
+	time.Sleep(4 * s.step)
+	overdue := false
+	s.do(func() { overdue = s.clients[id].overdue })
+	if !overdue {
+		t.Fatal("player was not stepped without its inputs")
+	}
+
+	//The late inputs move the player as far as if they had arrived in time
+	inputs := networking.Inputs{}
+	for i := 1; i <= 12; i++ {
+		inputs.Inputs = append(inputs.Inputs, networking.Input{Number: uint64(i), Tick: first.Tick + uint64(i), Up: true})
+	}
+	want := physics.HandleInputs(start, append([]networking.Input{first}, inputs.Inputs...), s.level.Cells)
+	if want.X == start.X && want.Y == start.Y {
+		t.Fatal("inputs do not move the player")
+	}
+	if err := player.Send(inputs, networking.InputsPacket); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var got networking.Player
+		s.do(func() { got = s.stepped(id) })
+		if got.LastInputNumber == 12 {
+			if math.Abs(got.X-want.X) > 1e-9 || math.Abs(got.Y-want.Y) > 1e-9 {
+				t.Errorf("player moved to %v, %v, want %v, %v", got.X, got.Y, want.X, want.Y)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("late inputs were never stepped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPingFlood(t *testing.T) {
+	_, transport := startServer(t, Config{})
+	player, _ := connect(t, transport, networking.PlayerInfo{Username: "player"})
+
+	go func() {
+		for i := 0; i < 4*networking.MaxControlBurst; i++ {
+			if err := player.Send(networking.Ping{}, networking.PingPacket); err != nil {
+				return
+			}
+		}
+	}()
+	data, err := player.recieve(networking.DisconnectPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := data.(networking.Disconnect).Reason; reason != networking.DisconnectViolation {
+		t.Fatalf("disconnected with %v, want %v", reason, networking.DisconnectViolation)
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"math"
+
+	"github.com/oyberntzen/Raycasting-in-Golang/game/physics"
+	"github.com/oyberntzen/Raycasting-in-Golang/networking"
+)
+
+//queuedEvent is an event waiting to be sent before the next snapshot
+type queuedEvent struct {
+	event networking.Event
+	//to is the only reciever, unless broadcast is set
+	to        uint16
+	broadcast bool
+	except    []uint16
+	//nearby limits a broadcast to the players interested in event.PlayerID
+	nearby bool
+}
+
+//sendEvent queues an event for one player
+func (s *Server) sendEvent(to uint16, event networking.Event) {
+	s.events = append(s.events, queuedEvent{event: event, to: to})
+}
+
+//broadcastEvent queues an event for every player except the players in except
+func (s *Server) broadcastEvent(event networking.Event, except ...uint16) {
+	s.events = append(s.events, queuedEvent{event: event, broadcast: true, except: except})
+}
+
+//nearbyEvent queues an event about event.PlayerID for the other players that are sent its position
+func (s *Server) nearbyEvent(event networking.Event) {
+	s.events = append(s.events, queuedEvent{event: event, broadcast: true, except: []uint16{event.PlayerID}, nearby: true})
+}
+
+//sendEvents sends the queued events in order and returns the players and spectators the events could not be sent
+//to. Spectators get every broadcast event
+func (s *Server) sendEvents(tick uint64) (map[uint16]bool, map[*networking.Protocol]bool) {
+	events := s.events
+	s.events = nil
+
+	failed := map[uint16]bool{}
+	failedSpectators := map[*networking.Protocol]bool{}
+	send := func(id uint16, c *client, event networking.Event) {
+		if err := c.out.send(event, networking.EventPacket); err != nil {
+			failed[id] = true
+		}
+	}
+	for _, queued := range events {
+		if !queued.broadcast {
+			if c, ok := s.clients[queued.to]; ok {
+				send(queued.to, c, queued.event)
+			}
+			continue
+		}
+	clients:
+		for id, c := range s.clients {
+			for _, except := range queued.except {
+				if id == except {
+					continue clients
+				}
+			}
+			if queued.nearby && !c.inInterest(queued.event.PlayerID, tick) {
+				continue
+			}
+			send(id, c, queued.event)
+		}
+		for prot, c := range s.spectators {
+			if err := c.out.send(queued.event, networking.EventPacket); err != nil {
+				failedSpectators[prot] = true
+			}
+		}
+	}
+	return failed, failedSpectators
+}
+
+//addInputs queues inputs for the next step. An input is never stepped before the input the player was last stepped
+//with, so no tick is stepped twice
+func (c *client) addInputs(inputs []networking.Input) {
+	for _, input := range inputs {
+		if n := len(c.inputs); n > 0 && input.Tick < c.inputs[n-1].Tick {
+			input.Tick = c.inputs[n-1].Tick
+		}
+		c.inputs = append(c.inputs, input)
+	}
+}
+
+//logInputs keeps the inputs of the player for inputLogTicks
+func (c *client) logInputs(inputs []networking.Input, tick uint64) {
+	logged := append(c.inputLog, inputs...)
+	i := 0
+	for i < len(logged)-1 && logged[i].Tick+inputLogTicks < tick {
+		i++
+	}
+	c.inputLog = logged[i:]
+}
+
+//inputsSinceSnapshot returns the inputs of other since the last snapshot sent to c, starting with the last input
+//the client has already seen. Without that snapshot only the inputs from the last step are returned
+func (s *Server) inputsSinceSnapshot(c *client, other networking.Player) []networking.Input {
+	prev, ok := c.history.Get(c.sentFrame)
+	if !ok {
+		return other.LastInputs
+	}
+	for _, prevOther := range prev.OtherPlayers {
+		if prevOther.PlayerID != other.PlayerID {
+			continue
+		}
+		logged := s.clients[other.PlayerID].inputLog
+		for i, input := range logged {
+			if input.Number >= prevOther.LastInputNumber {
+				return append([]networking.Input{}, logged[i:]...)
+			}
+		}
+	}
+	return other.LastInputs
+}
+
+//interested reports if the snapshots for player id should contain other. Other players are sent while they are
+//visible or within hearingRadius, and for interestGrace ticks after so they do not pop in and out at corners
+func (s *Server) interested(id uint16, other networking.Player, tick uint64) bool {
+	player := s.players[id]
+	c := s.clients[id]
+	dist := math.Hypot(other.X-player.X, other.Y-player.Y)
+	if dist <= hearingRadius || physics.Visible(player, other, s.level.Cells) {
+		c.interest[other.PlayerID] = tick
+		return true
+	}
+	return c.inInterest(other.PlayerID, tick)
+}
+
+//inInterest reports if other was visible or heard by the player within the last interestGrace ticks
+func (c *client) inInterest(other uint16, tick uint64) bool {
+	last, ok := c.interest[other]
+	return ok && tick-last <= interestGrace
+}
+
+//sendSnapshot sends the changes since the last snapshot the client acknowledged, or the full snapshot if
+//the client does not support deltas or no acknowledged snapshot is left in its history
+func (c *client) sendSnapshot(snapshot networking.Snapshot) error {
+	c.history.Add(snapshot)
+
+	if c.prot.Features.Has(networking.FeatureDeltaSnapshots) && c.acked {
+		if base, ok := c.history.Get(c.ack); ok {
+			return c.out.send(networking.DiffSnapshot(base, snapshot), networking.SnapshotDeltaPacket)
+		}
+	}
+	return c.out.send(snapshot, networking.SnapshotPacket)
+}
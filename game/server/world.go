@@ -0,0 +1,209 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/oyberntzen/Raycasting-in-Golang/game/levels"
+	"github.com/oyberntzen/Raycasting-in-Golang/game/physics"
+	"github.com/oyberntzen/Raycasting-in-Golang/networking"
+)
+
+//handleShots damages the closest player hit by each shot since the last step. Victims are moved back to where
+//they were when the shot was fired
+func (s *Server) handleShots() {
+	for id, c := range s.clients {
+		inputs := c.inputs
+		//The first input was already handled in the last step
+		for i := 1; i < len(inputs); i++ {
+			if !inputs[i].Shoot {
+				continue
+			}
+			shooter := physics.HandleInputs(s.stepped(id), inputs[:i+1], s.level.Cells)
+			s.nearbyEvent(networking.Event{Event: networking.ShootEvent, PlayerID: id})
+
+			victimID, hit, closest := uint16(0), false, math.Inf(1)
+			for otherID := range s.players {
+				if otherID == id {
+					continue
+				}
+				victim := s.rewindPlayer(otherID, inputs[i].Tick)
+				dist := math.Hypot(victim.X-shooter.X, victim.Y-shooter.Y)
+				if dist < closest && physics.Hit(shooter, victim, s.level.Cells) {
+					victimID, hit, closest = otherID, true, dist
+				}
+			}
+			if hit && s.mode.shotDamage > 0 {
+				s.damagePlayer(victimID, id)
+			}
+		}
+	}
+}
+
+//rewindPlayer returns the player as it was in the tick, using the inputs recieved since the last step
+func (s *Server) rewindPlayer(id uint16, tick uint64) networking.Player {
+	inputs := s.clients[id].inputs
+	if len(inputs) == 0 {
+		return s.players[id]
+	}
+	i := 0
+	for i < len(inputs)-1 && inputs[i+1].Tick <= tick {
+		i++
+	}
+	return physics.HandleInputs(s.stepped(id), inputs[:i+1], s.level.Cells)
+}
+
+//damagePlayer applies a hit from the attacker. A killed player respawns with full health
+func (s *Server) damagePlayer(victimID, attackerID uint16) {
+	victim := s.players[victimID]
+	if victim.Health > s.mode.shotDamage {
+		victim.Health -= s.mode.shotDamage
+		s.players[victimID] = victim
+		shot := networking.Event{Event: networking.ShotEvent, PlayerID: victimID, OtherID: attackerID, Health: victim.Health}
+		s.sendEvent(victimID, shot)
+		s.sendEvent(attackerID, shot)
+		return
+	}
+
+	spawn := s.spawnPlayer(victimID)
+	spawn.LastInputNumber = victim.LastInputNumber
+	s.players[victimID] = spawn
+	if c, ok := s.clients[victimID]; ok {
+		c.overdue = false
+	}
+	s.broadcastEvent(networking.Event{Event: networking.KillEvent, PlayerID: victimID, OtherID: attackerID})
+}
+
+//spawnPlayer returns a player at the spawn point with full health
+func (s *Server) spawnPlayer(id uint16) networking.Player {
+	return networking.Player{PlayerID: id, X: s.level.SpawnX, Y: s.level.SpawnY, Z: 0, Angle: s.level.SpawnAngle, Pitch: 0, Health: maxHealth}
+}
+
+//loadLevel replaces the world with the level
+func (s *Server) loadLevel(next levels.Level) {
+	s.level = next
+	s.entities = make(map[uint32]networking.Entity)
+	s.entityRespawns = make(map[uint32]uint64)
+	for _, entity := range next.Entities {
+		if entity.Kind == networking.PickupEntity && !s.mode.pickups {
+			continue
+		}
+		s.spawnEntity(entity)
+	}
+}
+
+//nextLevel changes to the next of Config.Levels
+func (s *Server) nextLevel(now time.Time) {
+	s.levelIndex = (s.levelIndex + 1) % len(s.config.Levels)
+	s.levelStart = now
+	s.changeLevel(s.config.Levels[s.levelIndex])
+}
+
+//changeLevel loads the level and respawns every player in it without disconnecting them. Each player and spectator
+//is sent LevelChange and ServerInfo for the new level
+func (s *Server) changeLevel(next levels.Level) {
+	tick := s.clock.Tick()
+	//Events from the old level are sent before it is dropped
+	failed, failedSpectators := s.sendEvents(tick)
+
+	s.logf("Changing level to %s", next.Name)
+	s.loadLevel(next)
+	s.sessions.Respawn(s.spawnPlayer)
+
+	for id, c := range s.clients {
+		spawn := s.spawnPlayer(id)
+		spawn.LastInputNumber = s.players[id].LastInputNumber
+		s.players[id] = spawn
+		c.overdue = false
+		if len(c.inputs) > 0 {
+			c.inputs = c.inputs[len(c.inputs)-1:]
+		}
+		c.inputLog = nil
+
+		//Snapshots of the old level can not be used as baselines
+		c.history = &networking.SnapshotHistory{}
+		c.acked = false
+		c.interest = make(map[uint16]uint64)
+
+		if failed[id] {
+			continue
+		}
+		info := networking.ServerInfo{ThisPlayer: spawn, Cells: next.Cells, Sprites: next.Sprites}
+		if err := c.out.send(networking.LevelChange{Name: next.Name, Tick: tick}, networking.LevelChangePacket); err != nil {
+			failed[id] = true
+		} else if err := c.out.send(info, networking.ServerInfoPacket); err != nil {
+			failed[id] = true
+		}
+	}
+
+	for prot, c := range s.spectators {
+		c.history = &networking.SnapshotHistory{}
+		c.acked = false
+		if failedSpectators[prot] {
+			continue
+		}
+		info := networking.ServerInfo{Cells: next.Cells, Sprites: next.Sprites}
+		if err := c.out.send(networking.LevelChange{Name: next.Name, Tick: tick}, networking.LevelChangePacket); err != nil {
+			failedSpectators[prot] = true
+		} else if err := c.out.send(info, networking.ServerInfoPacket); err != nil {
+			failedSpectators[prot] = true
+		}
+	}
+
+	for id := range failed {
+		s.drop(id, networking.DisconnectTimeout)
+	}
+	for prot := range failedSpectators {
+		s.unwatch(prot, networking.DisconnectTimeout)
+	}
+}
+
+//spawnEntity adds the entity to the world with a new EntityID
+func (s *Server) spawnEntity(entity networking.Entity) {
+	entity.EntityID = s.nextEntityID
+	s.nextEntityID++
+	s.entities[entity.EntityID] = entity
+}
+
+//updateEntities runs the game objects that are not players
+func (s *Server) updateEntities(tick uint64) {
+	for id, entity := range s.entities {
+		if entity.Kind != networking.PickupEntity {
+			continue
+		}
+		if entity.State == networking.PickupTaken {
+			if tick >= s.entityRespawns[id] {
+				entity.State = networking.PickupAvailable
+				delete(s.entityRespawns, id)
+				s.entities[id] = entity
+			}
+			continue
+		}
+		for playerID, player := range s.players {
+			if player.Health >= maxHealth || math.Hypot(player.X-entity.Sprite.X, player.Y-entity.Sprite.Y) > pickupRadius {
+				continue
+			}
+			if maxHealth-player.Health < pickupHealth {
+				player.Health = maxHealth
+			} else {
+				player.Health += pickupHealth
+			}
+			s.players[playerID] = player
+			entity.State = networking.PickupTaken
+			s.entities[id] = entity
+			s.entityRespawns[id] = tick + pickupRespawnTicks
+			break
+		}
+	}
+}
+
+//entityList returns every entity sorted by EntityID, so snapshots list them in the same order
+func (s *Server) entityList() []networking.Entity {
+	list := make([]networking.Entity, 0, len(s.entities))
+	for _, entity := range s.entities {
+		list = append(list, entity)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].EntityID < list[j].EntityID })
+	return list
+}
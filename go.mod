@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	github.com/enriquebris/goconcurrentqueue v0.6.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/hajimehoshi/ebiten v1.11.7
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 )
@@ -0,0 +1,241 @@
+package networking
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Capture Files
+
+A capture starts with captureMagic followed by
+	Version Uint8 (captureVersion)
+	Server  Bools (if the capture was recorded by the server)
+Then a record follows for every packet
+	Time      Uvarint (microseconds since the recording started)
+	Stream    Uvarint (the connection, numbered in the order Record was called)
+	Direction Uint8
+	Version   Uint8 (ProtocolVersion of the frame)
+	PacketID  Uint8
+	Payload   []Byte
+Tokens in PlayerInfo and HandshakeReply are blanked before they are written, so captures can be shared
+*/
+
+//captureVersion is the version of the capture format, not of the packets in it
+const captureVersion uint8 = 1
+
+var captureMagic = []byte("RAYCAP")
+
+//Direction tells if a captured packet was sent or recieved by the side that recorded it
+type Direction uint8
+
+//DirectionSent is the Direction of packets written by Send
+var DirectionSent Direction = 0
+
+//DirectionRecieved is the Direction of packets returned by Recieve
+var DirectionRecieved Direction = 1
+
+func (direction Direction) String() string {
+	switch direction {
+	case DirectionSent:
+		return "sent"
+	case DirectionRecieved:
+		return "recieved"
+	}
+	return fmt.Sprintf("direction %d", uint8(direction))
+}
+
+//CapturedPacket is one packet of a capture
+type CapturedPacket struct {
+	Time      time.Duration
+	Stream    uint32
+	Direction Direction
+	Version   uint8
+	ID        PacketID
+	Payload   []byte
+}
+
+//FromClient reports if the client sent the packet, given if the capture was recorded by the server
+func (packet CapturedPacket) FromClient(server bool) bool {
+	return server == (packet.Direction == DirectionRecieved)
+}
+
+//Recorder writes the packets of one or more Protocols to a capture. It is safe to use from several goroutines
+type Recorder struct {
+	lock    sync.Mutex
+	w       io.Writer
+	closer  io.Closer
+	start   time.Time
+	streams uint32
+	err     error
+}
+
+//NewRecorder writes the header of a capture to w. server tells readers which side recorded it
+func NewRecorder(w io.Writer, server bool) (*Recorder, error) {
+	header := writer{append([]byte{}, captureMagic...)}
+	header.uint8(captureVersion)
+	header.bools(server)
+	if _, err := w.Write(header.buf); err != nil {
+		return nil, err
+	}
+	return &Recorder{w: w, start: time.Now()}, nil
+}
+
+//CreateRecorder creates a capture file at path
+func CreateRecorder(path string, server bool) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	recorder, err := NewRecorder(file, server)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	recorder.closer = file
+	return recorder, nil
+}
+
+//Record captures every packet sent and recieved by prot from now on as a new stream. It must be called before
+//prot is used
+func (r *Recorder) Record(prot *Protocol) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	prot.recorder = r
+	prot.stream = r.streams
+	r.streams++
+}
+
+//record writes one packet. A record is written with a single Write, so a capture is never cut in the middle
+//of a record unless the disk is full
+func (r *Recorder) record(stream uint32, direction Direction, version uint8, id PacketID, payload []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return
+	}
+	w := writer{}
+	w.uvarint(uint64(time.Since(r.start) / time.Microsecond))
+	w.uvarint(uint64(stream))
+	w.uint8(uint8(direction))
+	w.uint8(version)
+	w.uint8(uint8(id))
+	payload = redact(version, id, payload)
+	w.uvarint(uint64(len(payload)))
+	w.buf = append(w.buf, payload...)
+	_, r.err = r.w.Write(w.buf)
+}
+
+//redact returns the payload without the tokens a player logs in or resumes with. Handshakes that can not be
+//decoded are left out, since the tokens can not be found in them
+func redact(version uint8, id PacketID, payload []byte) []byte {
+	if id != PlayerInfoPacket && id != HandshakeReplyPacket {
+		return payload
+	}
+	packet, err := DecodePacket(id, payload)
+	if version != ProtocolVersion || err != nil {
+		return nil
+	}
+	switch packet := packet.(type) {
+	case PlayerInfo:
+		packet.Token, packet.SessionToken = "", ""
+		payload, err = encodePayload(nil, packet)
+	case HandshakeReply:
+		packet.SessionToken = ""
+		payload, err = encodePayload(nil, packet)
+	}
+	if err != nil {
+		return nil
+	}
+	return payload
+}
+
+//Close stops recording and closes the file from CreateRecorder. The first error from writing is returned
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	err := r.err
+	if r.err == nil {
+		r.err = errors.New("recorder is closed")
+	}
+	if r.closer != nil {
+		if closeErr := r.closer.Close(); err == nil {
+			err = closeErr
+		}
+		r.closer = nil
+	}
+	return err
+}
+
+//CaptureReader reads the packets of a capture
+type CaptureReader struct {
+	//Server is true if the capture was recorded by the server
+	Server bool
+
+	reader *bufio.Reader
+}
+
+//NewCaptureReader reads the header of a capture
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(captureMagic)+2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(captureMagic)], captureMagic) {
+		return nil, errors.New("not a capture file")
+	}
+	if version := header[len(captureMagic)]; version != captureVersion {
+		return nil, fmt.Errorf("capture version %d is not supported", version)
+	}
+	return &CaptureReader{Server: header[len(captureMagic)+1]&1 != 0, reader: reader}, nil
+}
+
+//Next returns the next packet. io.EOF is returned at the end of the capture
+func (r *CaptureReader) Next() (CapturedPacket, error) {
+	packet := CapturedPacket{}
+	micros, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return packet, err
+	}
+	stream, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return packet, unexpectedEOF(err)
+	}
+	var header [3]byte
+	if _, err := io.ReadFull(r.reader, header[:]); err != nil {
+		return packet, unexpectedEOF(err)
+	}
+	length, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return packet, unexpectedEOF(err)
+	}
+	if length > maxFrameSize {
+		return packet, fmt.Errorf("invalid payload length %d", length)
+	}
+	packet.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r.reader, packet.Payload); err != nil {
+		return packet, unexpectedEOF(err)
+	}
+	packet.Time = time.Duration(micros) * time.Microsecond
+	packet.Stream = uint32(stream)
+	packet.Direction = Direction(header[0])
+	packet.Version = header[1]
+	packet.ID = PacketID(header[2])
+	return packet, nil
+}
+
+//unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, since only the start of a record may be at the end
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
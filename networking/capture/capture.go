@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oyberntzen/Raycasting-in-Golang/networking"
+)
+
+var (
+	packets      = flag.String("packets", "", "comma separated PacketIDs to show, empty for every packet")
+	stream       = flag.Int("stream", -1, "connection in the capture to show or replay, -1 for every connection or the first when replaying")
+	replayServer = flag.String("replay-server", "", "connect to the server at this address and send it what the client sent")
+	replayClient = flag.String("replay-client", "", "wait for a client on this address and send it what the server sent")
+	transport    = flag.String("transport", "tcp", "transport used to replay: "+strings.Join(networking.TransportNames(), ", "))
+	speed        = flag.Float64("speed", 1, "how much faster than recorded packets are replayed")
+
+	output     = json.NewEncoder(os.Stdout)
+	outputLock sync.Mutex
+	shown      map[networking.PacketID]bool
+)
+
+//replayLinger is how long replies are printed after the last packet is replayed
+const replayLinger = time.Second
+
+//line is what is printed for every packet
+type line struct {
+	Time      float64     `json:"time"`
+	Stream    uint32      `json:"stream"`
+	Direction string      `json:"direction"`
+	From      string      `json:"from"`
+	PacketID  uint8       `json:"packet"`
+	Type      string      `json:"type,omitempty"`
+	Version   uint8       `json:"version"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] capture\n\nPrints a capture from -record as JSON lines, or replays it with -replay-server or -replay-client.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	if shown, err = parsePacketIDs(*packets); err != nil {
+		log.Fatal(err)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	handleError(err)
+	defer file.Close()
+	capture, err := networking.NewCaptureReader(file)
+	handleError(err)
+
+	switch {
+	case *replayServer != "" && *replayClient != "":
+		log.Fatal("use either -replay-server or -replay-client")
+	case *replayServer != "":
+		t, err := networking.GetTransport(*transport)
+		handleError(err)
+		conn, err := t.Dial(*replayServer)
+		handleError(err)
+		handleError(replay(capture, true, conn))
+	case *replayClient != "":
+		t, err := networking.GetTransport(*transport)
+		handleError(err)
+		l, err := t.Listen(*replayClient)
+		handleError(err)
+		log.Printf("Waiting for a client on %v", l.Addr())
+		conn, err := l.Accept()
+		handleError(err)
+		l.Close()
+		handleError(replay(capture, false, conn))
+	default:
+		handleError(printCapture(capture))
+	}
+}
+
+//printCapture prints every packet of the capture that passes the filters
+func printCapture(capture *networking.CaptureReader) error {
+	for {
+		packet, err := capture.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if *stream >= 0 && packet.Stream != uint32(*stream) {
+			continue
+		}
+		show(packet, packet.FromClient(capture.Server))
+	}
+}
+
+//replay sends the packets of one stream that the client sent if asClient is set, otherwise those the server sent.
+//They are sent with the recorded time between them, and what the peer sends back is printed
+func replay(capture *networking.CaptureReader, asClient bool, conn net.Conn) error {
+	prot := networking.CreateProtocol(conn)
+	defer prot.Close()
+
+	start := time.Now()
+	replayStream := *stream
+	if replayStream >= 0 {
+		go showReplies(prot, uint32(replayStream), !asClient, start)
+	}
+	var first time.Duration = -1
+	for {
+		packet, err := capture.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if replayStream < 0 {
+			replayStream = int(packet.Stream)
+			go showReplies(prot, packet.Stream, !asClient, start)
+		}
+		if packet.Stream != uint32(replayStream) || packet.FromClient(capture.Server) != asClient {
+			continue
+		}
+
+		if first < 0 {
+			first = packet.Time
+		}
+		at := time.Duration(float64(packet.Time-first) / *speed)
+		time.Sleep(at - time.Since(start))
+
+		data, err := networking.DecodePacket(packet.ID, packet.Payload)
+		if err != nil {
+			log.Printf("Skipping packet %d: %v", packet.ID, err)
+			continue
+		}
+		if err := prot.Send(data, packet.ID); err != nil {
+			return err
+		}
+		//Replies are timed from the start of the replay, so the packets sent are too
+		packet.Time, packet.Direction = time.Since(start), networking.DirectionSent
+		show(packet, asClient)
+	}
+	if first < 0 {
+		return errors.New("nothing to replay in the capture")
+	}
+
+	time.Sleep(replayLinger)
+	return nil
+}
+
+//showReplies prints what the peer sends during a replay as part of the replayed stream
+func showReplies(prot *networking.Protocol, stream uint32, fromClient bool, start time.Time) {
+	for {
+		id, data, err := prot.Recieve()
+		if err != nil {
+			return
+		}
+		show(networking.CapturedPacket{Time: time.Since(start), Stream: stream, Direction: networking.DirectionRecieved, Version: networking.ProtocolVersion, ID: id, Payload: data}, fromClient)
+	}
+}
+
+//show prints the packet as one JSON line if it passes -packets
+func show(packet networking.CapturedPacket, fromClient bool) {
+	if shown != nil && !shown[packet.ID] {
+		return
+	}
+	l := line{Time: packet.Time.Seconds(), Stream: packet.Stream, Direction: packet.Direction.String(), From: "server", PacketID: uint8(packet.ID), Version: packet.Version}
+	if fromClient {
+		l.From = "client"
+	}
+	data, err := networking.DecodePacket(packet.ID, packet.Payload)
+	if err != nil {
+		l.Error = err.Error()
+	} else {
+		l.Type = reflect.TypeOf(data).Name()
+		l.Data = jsonData(data)
+	}
+
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	output.Encode(l)
+}
+
+//jsonData changes the packets that would not be readable as JSON. Byte slices are encoded as base64
+func jsonData(data interface{}) interface{} {
+	info, ok := data.(networking.ServerInfo)
+	if !ok {
+		return data
+	}
+	cells := make([][]int, len(info.Cells))
+	for i, row := range info.Cells {
+		cells[i] = make([]int, len(row))
+		for j, cell := range row {
+			cells[i][j] = int(cell)
+		}
+	}
+	return struct {
+		ThisPlayer networking.Player
+		Cells      [][]int
+		Sprites    []networking.Sprite
+	}{info.ThisPlayer, cells, info.Sprites}
+}
+
+//parsePacketIDs parses -packets. nil is returned if every packet is shown
+func parsePacketIDs(list string) (map[networking.PacketID]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+	ids := map[networking.PacketID]bool{}
+	for _, field := range strings.Split(list, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PacketID %q", field)
+		}
+		ids[networking.PacketID(id)] = true
+	}
+	return ids, nil
+}
+
+func handleError(err error) {
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,77 @@
+package networking
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCaptureRedactsTokens(t *testing.T) {
+	var capture bytes.Buffer
+	recorder, err := NewRecorder(&capture, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := []struct {
+		id     PacketID
+		packet interface{}
+	}{
+		{PlayerInfoPacket, PlayerInfo{Version: ProtocolVersion, Username: "player", Token: "secret", SessionToken: "session"}},
+		{HandshakeReplyPacket, HandshakeReply{Accepted: true, Version: ProtocolVersion, SessionToken: "session"}},
+		{PingPacket, Ping{ClientTime: 1}},
+	}
+	for _, test := range packets {
+		payload, err := encodePayload(nil, test.packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder.record(0, DirectionSent, ProtocolVersion, test.id, payload)
+	}
+	//A handshake of another version can not be redacted, so its payload is left out
+	recorder.record(0, DirectionRecieved, ProtocolVersion-1, PlayerInfoPacket, []byte("secret"))
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(capture.Bytes(), []byte("secret")) || bytes.Contains(capture.Bytes(), []byte("session")) {
+		t.Error("capture contains a token")
+	}
+	reader, err := NewCaptureReader(&capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for {
+		packet, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packet.Version != ProtocolVersion {
+			if len(packet.Payload) != 0 {
+				t.Errorf("handshake of version %d was written", packet.Version)
+			}
+			continue
+		}
+		decoded, err := DecodePacket(packet.ID, packet.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, decoded)
+	}
+
+	if len(got) != len(packets) {
+		t.Fatalf("got %d packets, want %d", len(got), len(packets))
+	}
+	if info := got[0].(PlayerInfo); info.Username != "player" || info.Token != "" || info.SessionToken != "" {
+		t.Errorf("got %+v", info)
+	}
+	if reply := got[1].(HandshakeReply); !reply.Accepted || reply.SessionToken != "" {
+		t.Errorf("got %+v", reply)
+	}
+	if ping := got[2].(Ping); ping.ClientTime != 1 {
+		t.Errorf("got %+v", ping)
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,6 +17,7 @@ import (
 	"github.com/enriquebris/goconcurrentqueue"
 
 	"github.com/hajimehoshi/ebiten"
+	"github.com/hajimehoshi/ebiten/ebitenutil"
 	"github.com/oyberntzen/Raycasting-in-Golang/game/graphics"
 	"github.com/oyberntzen/Raycasting-in-Golang/networking"
 )
@@ -20,10 +25,12 @@ import (
 var (
 	cells   [][]uint8
 	sprites []networking.Sprite
-	player  networking.Player
-	players []networking.Player
+	//entities are the world entities from the last snapshot
+	entities []networking.Entity
+	player   networking.Player
+	players  []networking.Player
 
-	playerID       uint8
+	playerID       uint16
 	gameState      int
 	input          networking.Input
 	mouseX, mouseY int16
@@ -31,7 +38,7 @@ var (
 	pressedSpace   bool
 	pressedShoot   bool
 	firstShake     bool
-	prot           networking.Protocol
+	prot           *networking.Protocol
 
 	oldPlayers []networking.Player
 	oldInputs  []networking.Input
@@ -39,12 +46,57 @@ var (
 
 	frame            uint64
 	lastOtherPlayers []networking.Player
+	snapshots        networking.SnapshotHistory
+	clock            = networking.NewClientClock()
+
+	playerNames = map[uint16]string{}
+	feed        []feedMessage
+	//disconnected is shown when gameState is 2
+	disconnected string
+	reconnecting bool
+	sessionToken string
+	//loadingLevel is the level announced by LevelChange until its ServerInfo arrives. Snapshots from before
+	//levelTick belong to the old level
+	loadingLevel string
+	levelTick    uint64
+	//inputProt is the connection updateInput sends on
+	inputProt *networking.Protocol
+	recorder  *networking.Recorder
+
+	//serverList is shown when gameState is 3
+	serverList      []networking.ServerAnnouncement
+	searching       bool
+	pressedListKey  bool
+	clientTransport networking.Transport
+	serverKeys      = []ebiten.Key{ebiten.Key1, ebiten.Key2, ebiten.Key3, ebiten.Key4, ebiten.Key5, ebiten.Key6, ebiten.Key7, ebiten.Key8, ebiten.Key9}
+
+	username  = flag.String("name", defaultUsername(), "username shown to the server")
+	transport = flag.String("transport", "udp", "transport used to connect to the server: "+strings.Join(networking.TransportNames(), ", ")+", tcp unless given with -tls-ca")
+	token     = flag.String("token", "", "login token, needed if the server uses a credentials file")
+	tlsCA     = flag.String("tls-ca", "", "certificate of the server, enables TLS")
+	rate      = flag.Uint("rate", 0, "snapshots per second to ask the server for, 0 for the server default")
+	simulated = networking.NetworkConditionFlags(flag.CommandLine)
+	record    = flag.String("record", "", "capture every packet to this file, see networking/capture")
+	server    = flag.String("server", "", "address of the server, empty to pick one of the servers on the LAN")
 )
 
 const (
 	width     int = 500
 	height    int = 500
 	scaleDown int = 2
+
+	feedDuration = 5 * time.Second
+	feedSize     = 5
+
+	//discoveryTimeout is how long the client waits for servers on the LAN to answer
+	discoveryTimeout = time.Second
+	//reconnectAttempts is how many times the client tries to resume its session after the connection drops
+	reconnectAttempts = 10
+	reconnectDelay    = 2 * time.Second
+
+	//syncBurst pings are sent quickly after joining, then one every syncInterval
+	syncBurst    = 10
+	syncInterval = 2 * time.Second
 )
 
 //Game is the struct that implements ebiten.Game
@@ -60,15 +112,54 @@ func (e *Exit) Error() string {
 //Update handles the logic
 func (g *Game) Update(screen *ebiten.Image) error {
 	if ebiten.IsKeyPressed(ebiten.KeyEscape) {
+		if gameState == 1 {
+			prot.Disconnect(networking.DisconnectQuit, "")
+		}
 		return &Exit{}
 	}
+
+	if gameState == 3 {
+		updateServerList()
+	}
+
+	//Events are queued by the connection and handled here so the feed is only used by the game loop
+	for events != nil && events.GetLen() > 0 {
+		val, err := events.Dequeue()
+		if err != nil {
+			break
+		}
+		handleEvent(val.(networking.Event))
+	}
+	for len(feed) > 0 && time.Now().After(feed[0].expires) {
+		feed = feed[1:]
+	}
 	return nil
 }
 
 //Draw handles displaying each frame
 func (g *Game) Draw(screen *ebiten.Image) {
 	if gameState == 1 {
-		graphics.Draw3D(screen, player, cells, sprites, players, width/scaleDown, height/scaleDown, physics.PlayerSize)
+		worldSprites := append([]networking.Sprite{}, sprites...)
+		for _, entity := range entities {
+			if !entity.Hidden() {
+				worldSprites = append(worldSprites, entity.Sprite)
+			}
+		}
+		graphics.Draw3D(screen, player, cells, worldSprites, players, width/scaleDown, height/scaleDown, physics.PlayerSize)
+		ebitenutil.DebugPrintAt(screen, fmt.Sprintf("Health %d", player.Health), 2, height/scaleDown-16)
+		for i, message := range feed {
+			ebitenutil.DebugPrintAt(screen, message.text, 2, 2+i*16)
+		}
+		if reconnecting {
+			ebitenutil.DebugPrintAt(screen, "Reconnecting...", 2, height/scaleDown-32)
+		} else if loadingLevel != "" {
+			ebitenutil.DebugPrintAt(screen, "Loading "+loadingLevel+"...", 2, height/scaleDown-32)
+		}
+	} else if gameState == 2 {
+		ebitenutil.DebugPrintAt(screen, disconnected, 2, 2)
+		ebitenutil.DebugPrintAt(screen, "Press Escape to exit", 2, 18)
+	} else if gameState == 3 {
+		drawServerList(screen)
 	}
 }
 
@@ -78,11 +169,49 @@ func (g *Game) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeigh
 }
 
 func main() {
+	flag.Parse()
+
+	//TLS needs a stream, so TCP is used unless another transport was asked for
+	if *tlsCA != "" {
+		given := false
+		flag.Visit(func(f *flag.Flag) {
+			given = given || f.Name == "transport"
+		})
+		if !given {
+			*transport = "tcp"
+		} else if *transport == "udp" {
+			handleError(errors.New("-tls-ca can not be used with -transport udp, use tcp or ws"))
+		}
+	}
 
-	c, _ := net.Dial("tcp", "localhost:8000")
-	defer c.Close()
+	t, err := networking.GetTransport(*transport)
+	handleError(err)
+	if *tlsCA != "" {
+		config, err := networking.LoadClientTLS(*tlsCA)
+		handleError(err)
+		if ws, ok := t.(networking.WebSocketTransport); ok {
+			ws.TLS = config
+			t = ws
+		} else {
+			t = networking.TLSTransport{Transport: t, Config: config}
+		}
+	}
+	if simulated.Enabled() {
+		t = networking.SimulatedTransport{Transport: t, Conditions: *simulated}
+	}
+	if *record != "" {
+		recorder, err = networking.CreateRecorder(*record, false)
+		handleError(err)
+		defer recorder.Close()
+	}
 
-	go serverConnection(c)
+	clientTransport = t
+	if *server != "" {
+		go connect(t, *server)
+	} else {
+		gameState = 3
+		go searchServers()
+	}
 
 	ebiten.SetWindowSize(width, height)
 	ebiten.SetWindowTitle("Raycasting")
@@ -90,122 +219,353 @@ func main() {
 	ebiten.SetRunnableOnUnfocused(true)
 	//ebiten.SetFullscreen(true)
 	if err := ebiten.RunGame(&Game{}); err != nil {
-		log.Fatal(err)
+		if _, ok := err.(*Exit); !ok {
+			log.Fatal(err)
+		}
 	}
 
 }
 
-func serverConnection(conn net.Conn) {
+//connect joins the server. When the connection drops it reconnects with the session token, so the server gives
+//back the same player
+func connect(t networking.Transport, address string) {
+	events = goconcurrentqueue.NewFIFO()
+	attempts := 0
+	for {
+		c, err := t.Dial(address)
+		if err == nil {
+			var joined bool
+			joined, err = serverConnection(c)
+			c.Close()
+			//Only a connection that got into the game gives the reconnects a fresh start
+			if joined {
+				attempts = 0
+			}
+		}
+
+		var disconnectErr *networking.DisconnectError
+		var rejectedErr *networking.RejectedError
+		if errors.As(err, &disconnectErr) {
+			disconnect(fmt.Sprintf("Disconnected by server: %v", disconnectErr.Reason))
+			return
+		}
+		if errors.As(err, &rejectedErr) || sessionToken == "" {
+			disconnect(fmt.Sprintf("Could not join server: %v", err))
+			return
+		}
+		if attempts >= reconnectAttempts {
+			disconnect(fmt.Sprintf("Lost connection to server: %v", err))
+			return
+		}
+		attempts++
+		reconnecting = true
+		log.Printf("Lost connection to server: %v, reconnecting (%d/%d)", err, attempts, reconnectAttempts)
+		time.Sleep(reconnectDelay)
+	}
+}
+
+//serverConnection handles one connection to the server and returns why it ended. joined tells if the handshake
+//was completed before that
+func serverConnection(conn net.Conn) (joined bool, err error) {
 	prot = networking.CreateProtocol(conn)
+	//Every connection is a new stream, so reconnects can be told apart in the capture
+	if recorder != nil {
+		recorder.Record(prot)
+	}
+
+	info := networking.PlayerInfo{Username: *username, Token: *token, SnapshotRate: uint8(*rate), SessionToken: sessionToken}
+	conn.SetReadDeadline(time.Now().Add(networking.HandshakeTimeout))
+	reply, err := prot.SendHandshake(info)
+	if err != nil {
+		return false, err
+	}
+	sessionToken = reply.SessionToken
+	log.Printf("Joined with %d snapshots per second", reply.SnapshotRate)
+
+	dispatcher := networking.NewDispatcher()
+	dispatcher.OnServerInfo(handleServerInfo)
+	dispatcher.OnSnapshot(handleSnapshot)
+	dispatcher.OnSnapshotDelta(handleSnapshotDelta)
+	dispatcher.OnLevelChange(handleLevelChange)
+	dispatcher.OnEvent(func(event networking.Event) error {
+		return events.Enqueue(event)
+	})
+	dispatcher.OnPong(func(pong networking.Pong) error {
+		clock.HandlePong(pong)
+		return nil
+	})
+	dispatcher.OnDisconnect(func(disconnect networking.Disconnect) error {
+		return &networking.DisconnectError{Reason: disconnect.Reason, Message: disconnect.Message}
+	})
+
+	go syncClock(prot)
 
 	for {
 
 		//Handle incoming packet
+		conn.SetReadDeadline(time.Now().Add(networking.IdleTimeout))
 		id, data, err := prot.Recieve()
-		handleError(err)
+		if err != nil {
+			return true, err
+		}
+
+		if err := dispatcher.Dispatch(id, data); err != nil {
+			var disconnectErr *networking.DisconnectError
+			if errors.As(err, &disconnectErr) {
+				return true, err
+			}
+			log.Println(err)
+		}
+
+	}
+}
+
+//searchServers looks for servers on the LAN and replaces serverList with the answers
+func searchServers() {
+	searching = true
+	servers, err := networking.Discover(discoveryTimeout)
+	if err != nil {
+		log.Printf("Could not search for servers: %v", err)
+	}
+	serverList = servers
+	searching = false
+}
+
+//updateServerList joins the server whose number is pressed, or searches again when R is pressed
+func updateServerList() {
+	pressed := false
+	for i, key := range serverKeys {
+		if i >= len(serverList) || !ebiten.IsKeyPressed(key) {
+			continue
+		}
+		pressed = true
+		if !pressedListKey && serverList[i].Version == networking.ProtocolVersion {
+			gameState = 0
+			go connect(clientTransport, serverList[i].Address)
+		}
+	}
+	if ebiten.IsKeyPressed(ebiten.KeyR) {
+		pressed = true
+		if !pressedListKey && !searching {
+			go searchServers()
+		}
+	}
+	pressedListKey = pressed
+}
 
-		if id != networking.NilPacket {
-			if id == networking.ServerInfoPacket && gameState == 0 {
-				serverInfo := prot.DecodeServerInfo(data)
+//drawServerList shows the servers found on the LAN. Servers with another protocol version can not be joined
+func drawServerList(screen *ebiten.Image) {
+	ebitenutil.DebugPrintAt(screen, "Servers on the LAN", 2, 2)
+	servers := serverList
+	for i, server := range servers {
+		if i >= len(serverKeys) {
+			break
+		}
+		line := fmt.Sprintf("%d. %s  %s  %d/%d", i+1, server.Name, server.Level, server.Players, server.MaxPlayers)
+		if server.Version != networking.ProtocolVersion {
+			line = fmt.Sprintf("   %s  (version %d)", server.Name, server.Version)
+		}
+		ebitenutil.DebugPrintAt(screen, line, 2, 34+i*16)
+	}
+	if searching {
+		ebitenutil.DebugPrintAt(screen, "Searching...", 2, 18)
+	} else if len(servers) == 0 {
+		ebitenutil.DebugPrintAt(screen, "No servers found, R to search again", 2, 18)
+	} else {
+		ebitenutil.DebugPrintAt(screen, "Press a number to join, R to search again", 2, 18)
+	}
+}
 
-				path, _ := os.Getwd()
-				imagesPath := filepath.Dir(filepath.Dir(path)) + "\\images\\"
-				graphics.Init(imagesPath, width/scaleDown, height/scaleDown)
+//disconnect shows why the client is no longer connected instead of the game
+func disconnect(message string) {
+	log.Println(message)
+	disconnected = message
+	gameState = 2
+}
 
-				cells = serverInfo.Cells
-				sprites = serverInfo.Sprites
+//handleLevelChange drops the current world until ServerInfo for the new level arrives
+func handleLevelChange(levelChange networking.LevelChange) error {
+	log.Printf("Changing level to %s", levelChange.Name)
+	loadingLevel = levelChange.Name
+	levelTick = levelChange.Tick
+	players = []networking.Player{}
+	lastOtherPlayers = nil
+	entities = nil
+	return nil
+}
 
-				player = serverInfo.ThisPlayer
+//handleServerInfo starts the game. It is sent again when the client resumes its session on a new connection and
+//after LevelChange
+func handleServerInfo(serverInfo networking.ServerInfo) error {
+	path, _ := os.Getwd()
+	imagesPath := filepath.Dir(filepath.Dir(path)) + "\\images\\"
+	graphics.Init(imagesPath, width/scaleDown, height/scaleDown)
+
+	cells = serverInfo.Cells
+	sprites = serverInfo.Sprites
+
+	player = serverInfo.ThisPlayer
+
+	playerID = serverInfo.ThisPlayer.PlayerID
+	input = networking.Input{}
+	players = []networking.Player{}
+	lastOtherPlayers = nil
+	entities = nil
+	snapshots = networking.SnapshotHistory{}
+
+	inputLock.Lock()
+	oldPlayers, oldInputs = nil, nil
+	inputLock.Unlock()
+
+	//Inputs keep going through a level change, but a new connection needs its own sender
+	if inputProt != prot {
+		inputProt = prot
+		go updateInput(prot)
+	}
 
-				events = goconcurrentqueue.NewFIFO()
-				playerID = serverInfo.ThisPlayer.PlayerID
-				input = networking.Input{}
-				players = []networking.Player{}
+	reconnecting = false
+	loadingLevel = ""
+	gameState = 1
+	return nil
+}
 
-				go updateInput()
+//handleSnapshot acknowledges the snapshot and corrects the predicted player. Snapshots are unreliable and may arrive before ServerInfo
+func handleSnapshot(snapshot networking.Snapshot) error {
+	if gameState != 1 || reconnecting || loadingLevel != "" || snapshot.Tick < levelTick {
+		return nil
+	}
+	snapshots.Add(snapshot)
+	if err := prot.Send(networking.SnapshotAck{Frame: snapshot.Frame}, networking.SnapshotAckPacket); err != nil {
+		return err
+	}
 
-				gameState = 1
+	newPlayer := snapshot.ThisPlayer
+	frame = snapshot.Frame
+	entities = snapshot.Entities
+	//Health is only changed by the server, for example by pickups
+	player.Health = newPlayer.Health
+
+	players = make([]networking.Player, len(lastOtherPlayers))
+	for i := 0; i < len(lastOtherPlayers); i++ {
+		players[i] = lastOtherPlayers[i]
+		for _, p := range snapshot.OtherPlayers {
+			if p.PlayerID == players[i].PlayerID && p.PlayerID != playerID {
+				players[i].LastInputs = make([]networking.Input, len(p.LastInputs))
+				copy(players[i].LastInputs, p.LastInputs)
+				go updateOtherPlayer(i, frame)
 			}
-			if id == networking.SnapshotPacket {
-				snapshot := prot.DecodeSnapshot(data)
-				newPlayer := snapshot.ThisPlayer
-				frame = snapshot.Frame
-
-				players = make([]networking.Player, len(lastOtherPlayers))
-				for i := 0; i < len(lastOtherPlayers); i++ {
-					players[i] = lastOtherPlayers[i]
-					for _, p := range snapshot.OtherPlayers {
-						if p.PlayerID == players[i].PlayerID && p.PlayerID != playerID {
-							players[i].LastInputs = make([]networking.Input, len(p.LastInputs))
-							copy(players[i].LastInputs, p.LastInputs)
-							go updateOtherPlayer(i, frame)
-						}
-					}
-
-				}
-
-				lastOtherPlayers = make([]networking.Player, len(snapshot.OtherPlayers))
-				for i := 0; i < len(snapshot.OtherPlayers); i++ {
-					lastOtherPlayers[i] = snapshot.OtherPlayers[i]
-				}
-
-				if len(oldPlayers) > 0 {
-					inputLock.Lock()
-					firstInputNumber := oldPlayers[0].LastInputNumber
-					if firstInputNumber < newPlayer.LastInputNumber {
-						diff := newPlayer.LastInputNumber - firstInputNumber
-						checkPlayer := oldPlayers[diff]
-						if !(newPlayer.Angle == checkPlayer.Angle && newPlayer.Pitch == checkPlayer.Pitch &&
-							newPlayer.X == checkPlayer.X && newPlayer.Y == checkPlayer.Y && newPlayer.Z == checkPlayer.Z) {
-							player = physics.HandleInputs(newPlayer, oldInputs[diff:], cells)
-						}
-						oldPlayers = oldPlayers[diff+1:]
-						oldInputs = oldInputs[diff+1:]
-					}
-					inputLock.Unlock()
-				}
+		}
+
+	}
+
+	lastOtherPlayers = make([]networking.Player, len(snapshot.OtherPlayers))
+	for i := 0; i < len(snapshot.OtherPlayers); i++ {
+		lastOtherPlayers[i] = snapshot.OtherPlayers[i]
+	}
 
+	if len(oldPlayers) > 0 {
+		inputLock.Lock()
+		firstInputNumber := oldPlayers[0].LastInputNumber
+		if firstInputNumber < newPlayer.LastInputNumber && newPlayer.LastInputNumber-firstInputNumber < uint64(len(oldPlayers)) {
+			diff := newPlayer.LastInputNumber - firstInputNumber
+			checkPlayer := oldPlayers[diff]
+			if !(newPlayer.Angle == checkPlayer.Angle && newPlayer.Pitch == checkPlayer.Pitch &&
+				newPlayer.X == checkPlayer.X && newPlayer.Y == checkPlayer.Y && newPlayer.Z == checkPlayer.Z) {
+				player = physics.HandleInputs(newPlayer, oldInputs[diff:], cells)
 			}
+			oldPlayers = oldPlayers[diff+1:]
+			oldInputs = oldInputs[diff+1:]
 		}
+		inputLock.Unlock()
+	}
+	return nil
+}
 
-		//Send pending event
-		/*if events.GetLen() > 0 {
-			val, err := events.Dequeue()
-			handleError(err)
-			if event, ok := val.(networking.Event); ok {
-				handleError(prot.Send(event, networking.EventPacket))
-			}
-		} else {
-			//Otherwise send input
-			newX, newY := ebiten.CursorPosition()
-			deltaX, deltaY := int16(newX*scaleDown)-mouseX, int16(newY*scaleDown)-mouseY
-			if (deltaX < 100 && deltaY < 100 && deltaX > -100 && deltaY > -100) || firstShake {
-				input.MouseX, input.MouseY = deltaX, deltaY
-			} else {
-				firstShake = true
-			}
-			mouseX, mouseY = int16(newX*scaleDown), int16(newY*scaleDown)
+//handleSnapshotDelta rebuilds the snapshot from its baseline. Deltas against a frame that is no longer in the history are dropped
+func handleSnapshotDelta(delta networking.SnapshotDelta) error {
+	base, ok := snapshots.Get(delta.BaseFrame)
+	if !ok {
+		return nil
+	}
+	return handleSnapshot(networking.ApplySnapshotDelta(base, delta))
+}
+
+//feedMessage is a line in the event feed shown until it expires
+type feedMessage struct {
+	text    string
+	expires time.Time
+}
+
+func addMessage(format string, a ...interface{}) {
+	feed = append(feed, feedMessage{text: fmt.Sprintf(format, a...), expires: time.Now().Add(feedDuration)})
+	if len(feed) > feedSize {
+		feed = feed[len(feed)-feedSize:]
+	}
+}
 
-			handleError(prot.Send(input, networking.InputPacket))
-			input = networking.Input{}
-		}*/
+//playerName returns the username of a player
+func playerName(id uint16) string {
+	if id == playerID {
+		return *username
+	}
+	if name, ok := playerNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("player %d", id)
+}
+
+//handleEvent updates the player and the feed. It is called from the game loop
+func handleEvent(event networking.Event) {
+	switch event.Event {
+	case networking.ShotEvent:
+		if event.PlayerID == playerID {
+			player.Health = event.Health
+			addMessage("%s hit you", playerName(event.OtherID))
+		} else {
+			addMessage("You hit %s", playerName(event.PlayerID))
+		}
+	case networking.KillEvent:
+		if event.PlayerID == playerID {
+			player.Health = 100
+		}
+		addMessage("%s killed %s", playerName(event.OtherID), playerName(event.PlayerID))
+	case networking.JoinEvent:
+		playerNames[event.PlayerID] = event.Name
+		addMessage("%s joined", event.Name)
+	case networking.LeaveEvent:
+		delete(playerNames, event.PlayerID)
+		addMessage("%s left (%v)", event.Name, event.Reason)
+	}
+	//JumpEvent and ShootEvent are drained with the rest, the other players are already animated from their inputs
+}
 
+//syncClock keeps the clock synchronised with the server until the connection is closed
+func syncClock(prot *networking.Protocol) {
+	for i := 0; ; i++ {
+		if err := prot.Send(clock.Ping(), networking.PingPacket); err != nil {
+			return
+		}
+		if i < syncBurst {
+			time.Sleep(100 * time.Millisecond)
+		} else {
+			time.Sleep(syncInterval)
+		}
 	}
 }
 
-func updateInput() {
-	last := float32(getTime())
-	lastInput := networking.Input{TimeStamp: last}
+func updateInput(prot *networking.Protocol) {
+	//Inputs are stamped with server ticks, so nothing is sent before the first pong
+	for !clock.Synced() {
+		time.Sleep(networking.TickDuration)
+	}
+	lastInput := networking.Input{Tick: clock.Tick()}
 	var number uint64 = 0
 	for {
-		time.Sleep(time.Second / 120)
-		now := float32(getTime())
-		delta := now - last
-
-		if delta < 0 {
-			delta += 60
+		time.Sleep(networking.TickDuration - clock.Now()%networking.TickDuration)
+		tick := clock.Tick()
+		if tick <= lastInput.Tick {
+			continue
 		}
-		last = now
 
 		if ebiten.IsKeyPressed(ebiten.KeyW) {
 			input.Up = true
@@ -221,7 +581,6 @@ func updateInput() {
 		}
 		if ebiten.IsKeyPressed(ebiten.KeySpace) {
 			if !pressedSpace {
-				//events.Enqueue(networking.Event{Event: networking.JumpEvent})
 				input.Jump = true
 				pressedSpace = true
 			}
@@ -230,7 +589,6 @@ func updateInput() {
 		}
 		if ebiten.IsMouseButtonPressed(ebiten.MouseButtonLeft) {
 			if !pressedShoot {
-				//events.Enqueue(networking.Event{Event: networking.ShootEvent})
 				input.Shoot = true
 				pressedShoot = true
 			}
@@ -246,19 +604,27 @@ func updateInput() {
 		}
 		mouseX, mouseY = int16(newX*scaleDown), int16(newY*scaleDown)
 
-		input.TimeStamp = now
+		input.Tick = tick
 		input.Number = number
 
 		player = physics.HandleInputs(player, []networking.Input{lastInput, input}, cells)
 		player.LastInputNumber = number
 		lastInput = input
 
+		//Every input the server has not acknowledged is sent again, so a lost packet does not lose inputs
 		inputLock.Lock()
 		oldPlayers = append(oldPlayers, player)
 		oldInputs = append(oldInputs, input)
+		unacked := oldInputs
+		if len(unacked) > networking.MaxRedundantInputs {
+			unacked = unacked[len(unacked)-networking.MaxRedundantInputs:]
+		}
+		packet := networking.Inputs{Inputs: append([]networking.Input{}, unacked...)}
 		inputLock.Unlock()
 
-		handleError(prot.Send(input, networking.InputPacket))
+		if err := prot.Send(packet, networking.InputsPacket); err != nil {
+			return
+		}
 		input = networking.Input{}
 
 		number++
@@ -274,11 +640,9 @@ func updateOtherPlayer(i int, f uint64) {
 		}
 		if num > 0 {
 			players[i] = physics.HandleInputs(players[i], []networking.Input{inputs[num-1], input}, cells)
-			delta := input.TimeStamp - inputs[num-1].TimeStamp
-			if delta < 0 {
-				delta += 60
+			if input.Tick > inputs[num-1].Tick {
+				time.Sleep(time.Duration(input.Tick-inputs[num-1].Tick) * networking.TickDuration)
 			}
-			time.Sleep(time.Duration(delta*1000000000) * time.Nanosecond)
 		}
 	}
 }
@@ -289,7 +653,9 @@ func handleError(err error) {
 	}
 }
 
-func getTime() float64 {
-	now := time.Now()
-	return float64(now.Nanosecond())/float64(time.Second) + float64(now.Second())
+func defaultUsername() string {
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "player"
 }
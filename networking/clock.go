@@ -0,0 +1,122 @@
+package networking
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	//TickRate is the number of ticks per second. Clients send one Input per tick
+	TickRate = 120
+	//TickDuration is the length of one tick
+	TickDuration = time.Second / TickRate
+)
+
+//clockSamples is the number of pongs the client offset is chosen from
+const clockSamples = 8
+
+//clockSample is the server time offset measured by one pong
+type clockSample struct {
+	rtt, offset time.Duration
+}
+
+//Clock counts the ticks since the server started. The server owns the clock and clients estimate it by sending
+//Ping and passing every Pong to HandlePong
+type Clock struct {
+	start time.Time
+
+	lock     sync.Mutex
+	offset   time.Duration
+	rtt      time.Duration
+	synced   bool
+	lastTick uint64
+	samples  []clockSample
+}
+
+//NewClock creates the server clock, starting at tick 0
+func NewClock() *Clock {
+	return &Clock{start: time.Now(), synced: true}
+}
+
+//NewClientClock creates a clock that is not synchronised until the first Pong is handled
+func NewClientClock() *Clock {
+	return &Clock{start: time.Now()}
+}
+
+//local is the time since the clock was created. It is monotonic and is not affected by changes to the wall clock
+func (c *Clock) local() time.Duration {
+	return time.Since(c.start)
+}
+
+//Now returns the estimated time since the server started
+func (c *Clock) Now() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.local() + c.offset
+}
+
+//Tick returns the current tick. It never goes backwards, even if a new Pong moves the clock back
+func (c *Clock) Tick() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.local() + c.offset
+	if now < 0 {
+		now = 0
+	}
+	tick := uint64(now / TickDuration)
+	if tick < c.lastTick {
+		return c.lastTick
+	}
+	c.lastTick = tick
+	return tick
+}
+
+//Synced reports if the clock is the server clock or at least one Pong has been handled
+func (c *Clock) Synced() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.synced
+}
+
+//RTT returns the round trip time of the sample the offset is based on
+func (c *Clock) RTT() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.rtt
+}
+
+//Ping creates a ping to send to the server
+func (c *Clock) Ping() Ping {
+	return Ping{ClientTime: uint64(c.local() / time.Microsecond)}
+}
+
+//Pong answers a ping from a client with the time of this clock
+func (c *Clock) Pong(ping Ping) Pong {
+	return Pong{ClientTime: ping.ClientTime, ServerTime: uint64(c.Now() / time.Microsecond)}
+}
+
+//HandlePong updates the offset to the server clock. The pong with the lowest round trip time of the last
+//clockSamples is used, since the time it took to reach the client is most likely half of it
+func (c *Clock) HandlePong(pong Pong) {
+	now := c.local()
+	sent := time.Duration(pong.ClientTime) * time.Microsecond
+	if sent > now {
+		return
+	}
+	rtt := now - sent
+	sample := clockSample{rtt: rtt, offset: time.Duration(pong.ServerTime)*time.Microsecond + rtt/2 - now}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.samples = append(c.samples, sample)
+	if len(c.samples) > clockSamples {
+		c.samples = c.samples[1:]
+	}
+	best := c.samples[0]
+	for _, s := range c.samples[1:] {
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+	c.offset, c.rtt, c.synced = best.offset, best.rtt, true
+}
@@ -0,0 +1,630 @@
+package networking
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+/*
+Binary encoding
+
+Every value is written in a fixed order without any type information, so both sides must agree on
+ProtocolVersion. Unsigned integers that are usually small are written as uvarints, signed integers
+as zig-zag varints, floats as little-endian IEEE 754 and booleans are packed up to eight per byte.
+Slices and strings are prefixed with their length as an uvarint.
+*/
+
+//errShortPayload is returned when a payload ends before every field is decoded
+var errShortPayload = errors.New("payload too short")
+
+//writer appends the binary encoding of values to a byte slice
+type writer struct {
+	buf []byte
+}
+
+func (w *writer) uint8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *writer) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	w.buf = append(w.buf, tmp[:n]...)
+}
+
+func (w *writer) varint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	w.buf = append(w.buf, tmp[:n]...)
+}
+
+func (w *writer) float64(v float64) {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+	w.buf = append(w.buf, tmp[:]...)
+}
+
+//bools packs up to eight booleans into one byte, the first value in the lowest bit
+func (w *writer) bools(values ...bool) {
+	var b uint8
+	for i, v := range values {
+		if v {
+			b |= 1 << uint(i)
+		}
+	}
+	w.uint8(b)
+}
+
+func (w *writer) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+//reader decodes values from a byte slice. The first error is kept and every later read returns zero values
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.buf = nil
+}
+
+func (r *reader) uint8() uint8 {
+	if len(r.buf) < 1 {
+		r.fail(errShortPayload)
+		return 0
+	}
+	v := r.buf[0]
+	r.buf = r.buf[1:]
+	return v
+}
+
+func (r *reader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail(errShortPayload)
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+//playerID reads a PlayerID written as an uvarint
+func (r *reader) playerID() uint16 {
+	v := r.uvarint()
+	if v > math.MaxUint16 {
+		r.fail(fmt.Errorf("player id %d out of range", v))
+		return 0
+	}
+	return uint16(v)
+}
+
+//entityID reads an EntityID written as an uvarint
+func (r *reader) entityID() uint32 {
+	v := r.uvarint()
+	if v > math.MaxUint32 {
+		r.fail(fmt.Errorf("entity id %d out of range", v))
+		return 0
+	}
+	return uint32(v)
+}
+
+func (r *reader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail(errShortPayload)
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *reader) float64() float64 {
+	if len(r.buf) < 8 {
+		r.fail(errShortPayload)
+		return 0
+	}
+	v := math.Float64frombits(binary.LittleEndian.Uint64(r.buf))
+	r.buf = r.buf[8:]
+	return v
+}
+
+//bools unpacks one byte into up to eight booleans
+func (r *reader) bools(values ...*bool) {
+	b := r.uint8()
+	for i, v := range values {
+		*v = b&(1<<uint(i)) != 0
+	}
+}
+
+//count reads the length of a slice. Every element takes at least minSize bytes, so a length that
+//can not fit in the rest of the payload is rejected before anything is allocated
+func (r *reader) count(minSize int) int {
+	n := r.uvarint()
+	if r.err != nil {
+		return 0
+	}
+	if n > uint64(len(r.buf)/minSize) {
+		r.fail(fmt.Errorf("length %d does not fit in payload", n))
+		return 0
+	}
+	return int(n)
+}
+
+func (r *reader) string() string {
+	n := r.count(1)
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+//done returns the first error, or an error if there are bytes left that were not decoded
+func (r *reader) done() error {
+	if r.err == nil && len(r.buf) > 0 {
+		return fmt.Errorf("%d unexpected bytes after payload", len(r.buf))
+	}
+	return r.err
+}
+
+/*
+Packet encodings
+*/
+
+func (w *writer) playerInfo(info PlayerInfo) {
+	w.uint8(info.Version)
+	w.string(info.Username)
+	w.string(info.Token)
+	w.uvarint(uint64(info.Features))
+	w.uint8(info.SnapshotRate)
+	w.string(info.SessionToken)
+}
+
+func (r *reader) playerInfo() PlayerInfo {
+	info := PlayerInfo{}
+	info.Version = r.uint8()
+	info.Username = r.string()
+	info.Token = r.string()
+	info.Features = Features(r.uvarint())
+	info.SnapshotRate = r.uint8()
+	info.SessionToken = r.string()
+	return info
+}
+
+func (w *writer) handshakeReply(reply HandshakeReply) {
+	w.bools(reply.Accepted)
+	w.uint8(reply.Version)
+	w.string(reply.Reason)
+	w.uvarint(uint64(reply.Features))
+	w.uint8(reply.SnapshotRate)
+	w.uint8(uint8(reply.Code))
+	w.string(reply.SessionToken)
+}
+
+func (r *reader) handshakeReply() HandshakeReply {
+	reply := HandshakeReply{}
+	r.bools(&reply.Accepted)
+	reply.Version = r.uint8()
+	reply.Reason = r.string()
+	reply.Features = Features(r.uvarint())
+	reply.SnapshotRate = r.uint8()
+	reply.Code = DisconnectReason(r.uint8())
+	reply.SessionToken = r.string()
+	return reply
+}
+
+func (w *writer) input(input Input) {
+	w.uvarint(input.Number)
+	w.uvarint(input.Tick)
+	w.bools(input.Up, input.Down, input.Left, input.Right, input.Jump, input.Shoot)
+	w.varint(int64(input.MouseX))
+	w.varint(int64(input.MouseY))
+}
+
+func (r *reader) input() Input {
+	input := Input{}
+	input.Number = r.uvarint()
+	input.Tick = r.uvarint()
+	r.bools(&input.Up, &input.Down, &input.Left, &input.Right, &input.Jump, &input.Shoot)
+	input.MouseX = int16(r.varint())
+	input.MouseY = int16(r.varint())
+	return input
+}
+
+func (w *writer) inputs(inputs Inputs) {
+	w.uvarint(uint64(len(inputs.Inputs)))
+	for _, input := range inputs.Inputs {
+		w.input(input)
+	}
+}
+
+func (r *reader) inputs() Inputs {
+	inputs := Inputs{Inputs: make([]Input, r.count(inputSize))}
+	for i := range inputs.Inputs {
+		inputs.Inputs[i] = r.input()
+	}
+	return inputs
+}
+
+func (w *writer) serverInfo(info ServerInfo) {
+	w.player(info.ThisPlayer)
+	w.uvarint(uint64(len(info.Cells)))
+	for _, row := range info.Cells {
+		w.uvarint(uint64(len(row)))
+		w.buf = append(w.buf, row...)
+	}
+	w.uvarint(uint64(len(info.Sprites)))
+	for _, sprite := range info.Sprites {
+		w.sprite(sprite)
+	}
+}
+
+func (r *reader) serverInfo() ServerInfo {
+	info := ServerInfo{}
+	info.ThisPlayer = r.player()
+	info.Cells = make([][]uint8, r.count(1))
+	for y := range info.Cells {
+		n := r.count(1)
+		info.Cells[y] = append([]uint8{}, r.buf[:n]...)
+		r.buf = r.buf[n:]
+	}
+	info.Sprites = make([]Sprite, r.count(spriteSize))
+	for i := range info.Sprites {
+		info.Sprites[i] = r.sprite()
+	}
+	return info
+}
+
+func (w *writer) snapshot(snapshot Snapshot) {
+	w.uvarint(snapshot.Frame)
+	w.uvarint(snapshot.Tick)
+	w.player(snapshot.ThisPlayer)
+	w.uvarint(uint64(len(snapshot.OtherPlayers)))
+	for _, player := range snapshot.OtherPlayers {
+		w.player(player)
+	}
+	w.uvarint(uint64(len(snapshot.Entities)))
+	for _, entity := range snapshot.Entities {
+		w.entity(entity)
+	}
+}
+
+func (r *reader) snapshot() Snapshot {
+	snapshot := Snapshot{}
+	snapshot.Frame = r.uvarint()
+	snapshot.Tick = r.uvarint()
+	snapshot.ThisPlayer = r.player()
+	snapshot.OtherPlayers = make([]Player, r.count(playerSize))
+	for i := range snapshot.OtherPlayers {
+		snapshot.OtherPlayers[i] = r.player()
+	}
+	snapshot.Entities = make([]Entity, r.count(entitySize))
+	for i := range snapshot.Entities {
+		snapshot.Entities[i] = r.entity()
+	}
+	return snapshot
+}
+
+func (w *writer) snapshotDelta(delta SnapshotDelta) {
+	w.uvarint(delta.Frame)
+	w.uvarint(delta.Frame - delta.BaseFrame)
+	w.uvarint(delta.Tick)
+	w.playerDelta(delta.ThisPlayer)
+	w.uvarint(uint64(len(delta.OtherPlayers)))
+	for _, playerDelta := range delta.OtherPlayers {
+		w.playerDelta(playerDelta)
+	}
+	w.uvarint(uint64(len(delta.Removed)))
+	for _, id := range delta.Removed {
+		w.uvarint(uint64(id))
+	}
+	w.uvarint(uint64(len(delta.Entities)))
+	for _, entity := range delta.Entities {
+		w.entity(entity)
+	}
+	w.uvarint(uint64(len(delta.RemovedEntities)))
+	for _, id := range delta.RemovedEntities {
+		w.uvarint(uint64(id))
+	}
+}
+
+func (r *reader) snapshotDelta() SnapshotDelta {
+	delta := SnapshotDelta{}
+	delta.Frame = r.uvarint()
+	delta.BaseFrame = delta.Frame - r.uvarint()
+	delta.Tick = r.uvarint()
+	delta.ThisPlayer = r.playerDelta()
+	delta.OtherPlayers = make([]PlayerDelta, r.count(2))
+	for i := range delta.OtherPlayers {
+		delta.OtherPlayers[i] = r.playerDelta()
+	}
+	delta.Removed = make([]uint16, r.count(1))
+	for i := range delta.Removed {
+		delta.Removed[i] = r.playerID()
+	}
+	delta.Entities = make([]Entity, r.count(entitySize))
+	for i := range delta.Entities {
+		delta.Entities[i] = r.entity()
+	}
+	delta.RemovedEntities = make([]uint32, r.count(1))
+	for i := range delta.RemovedEntities {
+		delta.RemovedEntities[i] = r.entityID()
+	}
+	return delta
+}
+
+func (w *writer) snapshotAck(ack SnapshotAck) {
+	w.uvarint(ack.Frame)
+}
+
+func (r *reader) snapshotAck() SnapshotAck {
+	return SnapshotAck{Frame: r.uvarint()}
+}
+
+func (w *writer) ping(ping Ping) {
+	w.uvarint(ping.ClientTime)
+}
+
+func (r *reader) ping() Ping {
+	return Ping{ClientTime: r.uvarint()}
+}
+
+func (w *writer) pong(pong Pong) {
+	w.uvarint(pong.ClientTime)
+	w.uvarint(pong.ServerTime)
+}
+
+func (r *reader) pong() Pong {
+	pong := Pong{}
+	pong.ClientTime = r.uvarint()
+	pong.ServerTime = r.uvarint()
+	return pong
+}
+
+func (w *writer) event(event Event) {
+	w.uint8(uint8(event.Event))
+	w.uvarint(uint64(event.PlayerID))
+	w.uvarint(uint64(event.OtherID))
+	w.uint8(event.Health)
+	w.string(event.Name)
+	w.uint8(uint8(event.Reason))
+}
+
+func (r *reader) event() Event {
+	event := Event{Event: EventID(r.uint8())}
+	event.PlayerID = r.playerID()
+	event.OtherID = r.playerID()
+	event.Health = r.uint8()
+	event.Name = r.string()
+	event.Reason = DisconnectReason(r.uint8())
+	return event
+}
+
+func (w *writer) levelChange(levelChange LevelChange) {
+	w.string(levelChange.Name)
+	w.uvarint(levelChange.Tick)
+}
+
+func (r *reader) levelChange() LevelChange {
+	levelChange := LevelChange{}
+	levelChange.Name = r.string()
+	levelChange.Tick = r.uvarint()
+	return levelChange
+}
+
+func (w *writer) disconnect(disconnect Disconnect) {
+	w.uint8(uint8(disconnect.Reason))
+	w.string(disconnect.Message)
+}
+
+func (r *reader) disconnect() Disconnect {
+	disconnect := Disconnect{}
+	disconnect.Reason = DisconnectReason(r.uint8())
+	disconnect.Message = r.string()
+	return disconnect
+}
+
+//spriteSize is the encoded size of a Sprite
+const spriteSize = 5*8 + 1
+
+func (w *writer) sprite(sprite Sprite) {
+	w.float64(sprite.X)
+	w.float64(sprite.Y)
+	w.float64(sprite.Z)
+	w.float64(sprite.W)
+	w.float64(sprite.H)
+	w.uint8(sprite.Texture)
+}
+
+func (r *reader) sprite() Sprite {
+	sprite := Sprite{}
+	sprite.X = r.float64()
+	sprite.Y = r.float64()
+	sprite.Z = r.float64()
+	sprite.W = r.float64()
+	sprite.H = r.float64()
+	sprite.Texture = r.uint8()
+	return sprite
+}
+
+//entitySize is the smallest encoded size of an Entity
+const entitySize = 1 + 1 + 1 + spriteSize
+
+func (w *writer) entity(entity Entity) {
+	w.uvarint(uint64(entity.EntityID))
+	w.uint8(uint8(entity.Kind))
+	w.uint8(entity.State)
+	w.sprite(entity.Sprite)
+}
+
+func (r *reader) entity() Entity {
+	entity := Entity{}
+	entity.EntityID = r.entityID()
+	entity.Kind = EntityKind(r.uint8())
+	entity.State = r.uint8()
+	entity.Sprite = r.sprite()
+	return entity
+}
+
+//playerSize is the smallest encoded size of a Player
+const playerSize = 1 + 1 + 1 + 6*8 + 1
+
+//inputSize is the smallest encoded size of an Input
+const inputSize = 1 + 1 + 1 + 1 + 1
+
+func (w *writer) player(player Player) {
+	w.uvarint(uint64(player.PlayerID))
+	w.uvarint(player.LastInputNumber)
+	w.uvarint(uint64(len(player.LastInputs)))
+	for _, input := range player.LastInputs {
+		w.input(input)
+	}
+	w.float64(player.X)
+	w.float64(player.Y)
+	w.float64(player.Z)
+	w.float64(player.Angle)
+	w.float64(player.Pitch)
+	w.float64(player.Vel)
+	w.uint8(player.Health)
+}
+
+//playerDelta writes the PlayerID, the changed fields and then only the fields that changed
+func (w *writer) playerDelta(delta PlayerDelta) {
+	player := delta.Player
+	w.uvarint(uint64(player.PlayerID))
+	w.uvarint(uint64(delta.Changed))
+	if delta.Changed&FieldLastInputNumber != 0 {
+		w.uvarint(player.LastInputNumber)
+	}
+	if delta.Changed&FieldLastInputs != 0 {
+		w.uvarint(uint64(len(player.LastInputs)))
+		for _, input := range player.LastInputs {
+			w.input(input)
+		}
+	}
+	for i, v := range []float64{player.X, player.Y, player.Z, player.Angle, player.Pitch, player.Vel} {
+		if delta.Changed&(FieldX<<uint(i)) != 0 {
+			w.float64(v)
+		}
+	}
+	if delta.Changed&FieldHealth != 0 {
+		w.uint8(player.Health)
+	}
+}
+
+func (r *reader) playerDelta() PlayerDelta {
+	delta := PlayerDelta{}
+	player := &delta.Player
+	player.PlayerID = r.playerID()
+	delta.Changed = PlayerFields(r.uvarint())
+	if delta.Changed&FieldLastInputNumber != 0 {
+		player.LastInputNumber = r.uvarint()
+	}
+	if delta.Changed&FieldLastInputs != 0 {
+		player.LastInputs = make([]Input, r.count(inputSize))
+		for i := range player.LastInputs {
+			player.LastInputs[i] = r.input()
+		}
+	}
+	for i, v := range []*float64{&player.X, &player.Y, &player.Z, &player.Angle, &player.Pitch, &player.Vel} {
+		if delta.Changed&(FieldX<<uint(i)) != 0 {
+			*v = r.float64()
+		}
+	}
+	if delta.Changed&FieldHealth != 0 {
+		player.Health = r.uint8()
+	}
+	return delta
+}
+
+func (r *reader) player() Player {
+	player := Player{}
+	player.PlayerID = r.playerID()
+	player.LastInputNumber = r.uvarint()
+	player.LastInputs = make([]Input, r.count(inputSize))
+	for i := range player.LastInputs {
+		player.LastInputs[i] = r.input()
+	}
+	player.X = r.float64()
+	player.Y = r.float64()
+	player.Z = r.float64()
+	player.Angle = r.float64()
+	player.Pitch = r.float64()
+	player.Vel = r.float64()
+	player.Health = r.uint8()
+	return player
+}
+
+//decoders decode the payload of every packet. DecodePacket, the Decode methods of Protocol and Dispatcher all
+//decode through it, so a new packet only has to be added here and to encodePayload
+var decoders = map[PacketID]func(r *reader) interface{}{
+	PlayerInfoPacket:     func(r *reader) interface{} { return r.playerInfo() },
+	HandshakeReplyPacket: func(r *reader) interface{} { return r.handshakeReply() },
+	InputPacket:          func(r *reader) interface{} { return r.input() },
+	InputsPacket:         func(r *reader) interface{} { return r.inputs() },
+	ServerInfoPacket:     func(r *reader) interface{} { return r.serverInfo() },
+	SnapshotPacket:       func(r *reader) interface{} { return r.snapshot() },
+	SnapshotDeltaPacket:  func(r *reader) interface{} { return r.snapshotDelta() },
+	SnapshotAckPacket:    func(r *reader) interface{} { return r.snapshotAck() },
+	EventPacket:          func(r *reader) interface{} { return r.event() },
+	PingPacket:           func(r *reader) interface{} { return r.ping() },
+	PongPacket:           func(r *reader) interface{} { return r.pong() },
+	LevelChangePacket:    func(r *reader) interface{} { return r.levelChange() },
+	DisconnectPacket:     func(r *reader) interface{} { return r.disconnect() },
+}
+
+//DecodePacket decodes the payload of any packet, such as a Snapshot for SnapshotPacket. A *DecodeError is returned
+//if data is invalid or the PacketID is unknown
+func DecodePacket(id PacketID, data []byte) (interface{}, error) {
+	decode, ok := decoders[id]
+	if !ok {
+		return nil, &DecodeError{id, errors.New("unknown packet")}
+	}
+	r := reader{buf: data}
+	packet := decode(&r)
+	if err := r.done(); err != nil {
+		return packet, &DecodeError{id, err}
+	}
+	return packet, nil
+}
+
+//encodePayload appends the encoding of data to buf
+func encodePayload(buf []byte, data interface{}) ([]byte, error) {
+	w := writer{buf}
+	switch data := data.(type) {
+	case PlayerInfo:
+		w.playerInfo(data)
+	case HandshakeReply:
+		w.handshakeReply(data)
+	case Input:
+		w.input(data)
+	case Inputs:
+		w.inputs(data)
+	case ServerInfo:
+		w.serverInfo(data)
+	case Snapshot:
+		w.snapshot(data)
+	case SnapshotDelta:
+		w.snapshotDelta(data)
+	case SnapshotAck:
+		w.snapshotAck(data)
+	case Event:
+		w.event(data)
+	case Ping:
+		w.ping(data)
+	case Pong:
+		w.pong(data)
+	case LevelChange:
+		w.levelChange(data)
+	case Disconnect:
+		w.disconnect(data)
+	default:
+		return buf, fmt.Errorf("can not encode %T", data)
+	}
+	return w.buf, nil
+}
@@ -0,0 +1,172 @@
+package networking
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+var testInputs = []Input{
+	{Tick: 1, Number: 7, Up: true, Right: true, MouseX: -300, MouseY: 12},
+	{Tick: math.MaxUint64, Number: math.MaxUint64, Down: true, Left: true, Jump: true, Shoot: true, MouseX: math.MinInt16, MouseY: math.MaxInt16},
+}
+
+var testPlayer = Player{PlayerID: math.MaxUint16, LastInputNumber: 300, LastInputs: testInputs, X: 1.5, Y: -2.25, Z: 0.4, Angle: math.Pi, Pitch: -1, Vel: 0.043, Health: 100}
+
+var testEntity = Entity{EntityID: math.MaxUint32, Kind: PickupEntity, State: PickupTaken, Sprite: Sprite{X: 3, Y: 4, Z: 0.5, W: 1, H: 2, Texture: 10}}
+
+//testPackets has a packet of every type with every field set
+var testPackets = []struct {
+	id     PacketID
+	packet interface{}
+}{
+	{PlayerInfoPacket, PlayerInfo{Version: ProtocolVersion, Username: "player", Token: "token", Features: SupportedFeatures, SnapshotRate: 30, SessionToken: "session"}},
+	{HandshakeReplyPacket, HandshakeReply{Accepted: true, Version: ProtocolVersion, Reason: "reason", Features: FeatureDeltaSnapshots, SnapshotRate: 20, Code: DisconnectServerFull, SessionToken: "session"}},
+	{InputPacket, testInputs[1]},
+	{InputsPacket, Inputs{Inputs: testInputs}},
+	{ServerInfoPacket, ServerInfo{ThisPlayer: testPlayer, Cells: [][]uint8{{1, 1, 1}, {1, 0, 255}}, Sprites: []Sprite{testEntity.Sprite}}},
+	{SnapshotPacket, Snapshot{Frame: 1 << 40, Tick: 99, ThisPlayer: testPlayer, OtherPlayers: []Player{testPlayer, {LastInputs: []Input{}}}, Entities: []Entity{testEntity}}},
+	{SnapshotDeltaPacket, SnapshotDelta{
+		Frame: 100, BaseFrame: 90, Tick: 5,
+		ThisPlayer:      PlayerDelta{Changed: FieldX | FieldHealth, Player: Player{PlayerID: 3, X: 2, Health: 50}},
+		OtherPlayers:    []PlayerDelta{{Changed: AllPlayerFields, Player: testPlayer}},
+		Removed:         []uint16{1, math.MaxUint16},
+		Entities:        []Entity{testEntity},
+		RemovedEntities: []uint32{0, math.MaxUint32},
+	}},
+	{SnapshotAckPacket, SnapshotAck{Frame: math.MaxUint64}},
+	{EventPacket, Event{Event: LeaveEvent, PlayerID: 2, OtherID: 1000, Health: 90, Name: "name", Reason: DisconnectTimeout}},
+	{PingPacket, Ping{ClientTime: 123456789}},
+	{PongPacket, Pong{ClientTime: 1, ServerTime: math.MaxUint64}},
+	{LevelChangePacket, LevelChange{Name: "Level02", Tick: 42}},
+	{DisconnectPacket, Disconnect{Reason: DisconnectViolation, Message: "bye"}},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, test := range testPackets {
+		payload, err := encodePayload(nil, test.packet)
+		if err != nil {
+			t.Fatalf("%T: %v", test.packet, err)
+		}
+		decoded, err := DecodePacket(test.id, payload)
+		if err != nil {
+			t.Fatalf("%T: %v", test.packet, err)
+		}
+		if !reflect.DeepEqual(decoded, test.packet) {
+			t.Errorf("%T changed in the round trip:\n got %+v\nwant %+v", test.packet, decoded, test.packet)
+		}
+		if max := MaxPayloadSize(test.id); len(payload) > max {
+			t.Errorf("%T is %d bytes, more than MaxPayloadSize %d", test.packet, len(payload), max)
+		}
+	}
+}
+
+func TestCodecTruncated(t *testing.T) {
+	for _, test := range testPackets {
+		payload, _ := encodePayload(nil, test.packet)
+		for n := 0; n < len(payload); n++ {
+			_, err := DecodePacket(test.id, payload[:n])
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) || decodeErr.ID != test.id {
+				t.Fatalf("%T cut to %d of %d bytes: got %v, want a *DecodeError", test.packet, n, len(payload), err)
+			}
+		}
+		if _, err := DecodePacket(test.id, append(payload, 0)); err == nil {
+			t.Errorf("%T with a trailing byte decoded without error", test.packet)
+		}
+	}
+}
+
+func TestCodecUnknownPacket(t *testing.T) {
+	if _, err := DecodePacket(NilPacket, nil); err == nil {
+		t.Error("NilPacket decoded without error")
+	}
+	if _, err := encodePayload(nil, struct{}{}); err == nil {
+		t.Error("unknown type encoded without error")
+	}
+}
+
+func TestBools(t *testing.T) {
+	for buttons := 0; buttons < 1<<6; buttons++ {
+		bit := func(i uint) bool { return buttons&(1<<i) != 0 }
+		input := Input{Up: bit(0), Down: bit(1), Left: bit(2), Right: bit(3), Jump: bit(4), Shoot: bit(5)}
+		w := writer{}
+		w.input(input)
+		//Number, Tick, the packed buttons and two varints of 0
+		if len(w.buf) != 5 || w.buf[2] != uint8(buttons) {
+			t.Fatalf("buttons %06b encoded as %v", buttons, w.buf)
+		}
+		r := reader{buf: w.buf}
+		if decoded := r.input(); decoded != input || r.done() != nil {
+			t.Fatalf("buttons %06b decoded as %+v", buttons, decoded)
+		}
+	}
+
+	var a, b, c bool
+	r := reader{buf: []byte{0xff}}
+	r.bools(&a, &b, &c)
+	if !a || !b || !c || r.done() != nil {
+		t.Error("unused bits changed the result")
+	}
+}
+
+func TestUvarintBounds(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 1<<14 - 1, 1 << 14, math.MaxUint32, math.MaxUint64} {
+		w := writer{}
+		w.uvarint(v)
+		r := reader{buf: w.buf}
+		if got := r.uvarint(); got != v || r.done() != nil {
+			t.Errorf("uvarint %d decoded as %d: %v", v, got, r.done())
+		}
+	}
+	for _, v := range []int64{0, -1, 1, math.MinInt64, math.MaxInt64} {
+		w := writer{}
+		w.varint(v)
+		r := reader{buf: w.buf}
+		if got := r.varint(); got != v || r.done() != nil {
+			t.Errorf("varint %d decoded as %d: %v", v, got, r.done())
+		}
+	}
+
+	//An uvarint longer than 64 bits is invalid
+	r := reader{buf: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}}
+	r.uvarint()
+	if r.done() == nil {
+		t.Error("overflowing uvarint decoded without error")
+	}
+
+	w := writer{}
+	w.uvarint(math.MaxUint16 + 1)
+	r = reader{buf: w.buf}
+	if r.playerID(); r.done() == nil {
+		t.Error("player id above MaxUint16 decoded without error")
+	}
+	w = writer{}
+	w.uvarint(math.MaxUint32 + 1)
+	r = reader{buf: w.buf}
+	if r.entityID(); r.done() == nil {
+		t.Error("entity id above MaxUint32 decoded without error")
+	}
+}
+
+func TestCountBounds(t *testing.T) {
+	//A length that can not fit in the payload is rejected before anything is allocated
+	w := writer{}
+	w.uvarint(math.MaxUint64)
+	if _, err := DecodePacket(InputsPacket, w.buf); err == nil {
+		t.Error("huge Inputs length decoded without error")
+	}
+	w = writer{}
+	w.uvarint(2)
+	w.input(Input{})
+	if _, err := DecodePacket(InputsPacket, w.buf); err == nil {
+		t.Error("Inputs with a missing input decoded without error")
+	}
+	w = writer{}
+	w.string("abc")
+	r := reader{buf: w.buf[:len(w.buf)-1]}
+	if r.string(); r.done() == nil {
+		t.Error("truncated string decoded without error")
+	}
+}
@@ -0,0 +1,96 @@
+package networking
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+Credentials File
+
+One player per line, blank lines and lines starting with # are ignored
+	username sha256-of-token-in-hex
+
+Only hashes are stored, so the file does not reveal the tokens players log in with.
+*/
+
+//Credentials contains the token hash of every player that may join
+type Credentials map[string][]byte
+
+//LoadCredentials reads a credentials file
+func LoadCredentials(path string) (Credentials, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	credentials := Credentials{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected username and token hash", path, line)
+		}
+		hash, err := hex.DecodeString(fields[1])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid token hash", path, line)
+		}
+		credentials[fields[0]] = hash
+	}
+	return credentials, scanner.Err()
+}
+
+//Check reports if the token belongs to the username
+func (c Credentials) Check(username, token string) bool {
+	hash, ok := c[username]
+	if !ok {
+		//The token is still hashed so unknown usernames take as long as wrong tokens
+		hash = make([]byte, sha256.Size)
+	}
+	sum := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(hash, sum[:]) == 1 && ok
+}
+
+//AddCredential creates a random token for the username and appends its hash to the credentials file. The token is returned
+//so it can be handed to the player
+func AddCredential(path, username string) (string, error) {
+	if username == "" || strings.ContainsAny(username, " \t\n#") {
+		return "", fmt.Errorf("invalid username %q", username)
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(token))
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintf(file, "%s %s\n", username, hex.EncodeToString(sum[:])); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+//randomToken returns 16 random bytes in hex
+func randomToken() (string, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tokenBytes), nil
+}
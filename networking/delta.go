@@ -0,0 +1,228 @@
+package networking
+
+//PlayerFields is a set of fields in Player
+type PlayerFields uint16
+
+var (
+	//FieldLastInputNumber is Player.LastInputNumber
+	FieldLastInputNumber PlayerFields = 1 << 0
+	//FieldLastInputs is Player.LastInputs
+	FieldLastInputs PlayerFields = 1 << 1
+	//FieldX is Player.X
+	FieldX PlayerFields = 1 << 2
+	//FieldY is Player.Y
+	FieldY PlayerFields = 1 << 3
+	//FieldZ is Player.Z
+	FieldZ PlayerFields = 1 << 4
+	//FieldAngle is Player.Angle
+	FieldAngle PlayerFields = 1 << 5
+	//FieldPitch is Player.Pitch
+	FieldPitch PlayerFields = 1 << 6
+	//FieldVel is Player.Vel
+	FieldVel PlayerFields = 1 << 7
+	//FieldHealth is Player.Health
+	FieldHealth PlayerFields = 1 << 8
+
+	//AllPlayerFields contains every field, used for players that are not in the baseline
+	AllPlayerFields PlayerFields = 1<<9 - 1
+)
+
+//PlayerDelta contains a player where only the fields in Changed are set. The other fields keep their value from the baseline
+type PlayerDelta struct {
+	Changed PlayerFields
+	Player  Player
+}
+
+//SnapshotDelta contains the changes from the snapshot with frame BaseFrame to the snapshot with frame Frame.
+//Players and entities that did not change are left out
+type SnapshotDelta struct {
+	Frame, BaseFrame uint64
+	Tick             uint64
+	ThisPlayer       PlayerDelta
+	OtherPlayers     []PlayerDelta
+	Removed          []uint16
+	Entities         []Entity
+	RemovedEntities  []uint32
+}
+
+//SnapshotAck is sent by the client for every snapshot it has recieved, so the server can use it as a baseline
+type SnapshotAck struct {
+	Frame uint64
+}
+
+//DiffPlayer returns the fields of player that differ from base
+func DiffPlayer(base, player Player) PlayerDelta {
+	var changed PlayerFields
+	if player.LastInputNumber != base.LastInputNumber {
+		changed |= FieldLastInputNumber
+	}
+	if !inputsEqual(player.LastInputs, base.LastInputs) {
+		changed |= FieldLastInputs
+	}
+	if player.X != base.X {
+		changed |= FieldX
+	}
+	if player.Y != base.Y {
+		changed |= FieldY
+	}
+	if player.Z != base.Z {
+		changed |= FieldZ
+	}
+	if player.Angle != base.Angle {
+		changed |= FieldAngle
+	}
+	if player.Pitch != base.Pitch {
+		changed |= FieldPitch
+	}
+	if player.Vel != base.Vel {
+		changed |= FieldVel
+	}
+	if player.Health != base.Health {
+		changed |= FieldHealth
+	}
+	return PlayerDelta{Changed: changed, Player: player}
+}
+
+//ApplyPlayerDelta returns base with the changed fields from delta
+func ApplyPlayerDelta(base Player, delta PlayerDelta) Player {
+	player := base
+	player.PlayerID = delta.Player.PlayerID
+	changed := delta.Changed
+	if changed&FieldLastInputNumber != 0 {
+		player.LastInputNumber = delta.Player.LastInputNumber
+	}
+	if changed&FieldLastInputs != 0 {
+		player.LastInputs = delta.Player.LastInputs
+	}
+	player.LastInputs = append([]Input{}, player.LastInputs...)
+	if changed&FieldX != 0 {
+		player.X = delta.Player.X
+	}
+	if changed&FieldY != 0 {
+		player.Y = delta.Player.Y
+	}
+	if changed&FieldZ != 0 {
+		player.Z = delta.Player.Z
+	}
+	if changed&FieldAngle != 0 {
+		player.Angle = delta.Player.Angle
+	}
+	if changed&FieldPitch != 0 {
+		player.Pitch = delta.Player.Pitch
+	}
+	if changed&FieldVel != 0 {
+		player.Vel = delta.Player.Vel
+	}
+	if changed&FieldHealth != 0 {
+		player.Health = delta.Player.Health
+	}
+	return player
+}
+
+//DiffSnapshot returns the changes from base to snapshot
+func DiffSnapshot(base, snapshot Snapshot) SnapshotDelta {
+	delta := SnapshotDelta{Frame: snapshot.Frame, BaseFrame: base.Frame, Tick: snapshot.Tick}
+	delta.ThisPlayer = DiffPlayer(base.ThisPlayer, snapshot.ThisPlayer)
+
+	basePlayers := make(map[uint16]Player, len(base.OtherPlayers))
+	for _, player := range base.OtherPlayers {
+		basePlayers[player.PlayerID] = player
+	}
+
+	for _, player := range snapshot.OtherPlayers {
+		basePlayer, ok := basePlayers[player.PlayerID]
+		if !ok {
+			delta.OtherPlayers = append(delta.OtherPlayers, PlayerDelta{Changed: AllPlayerFields, Player: player})
+			continue
+		}
+		delete(basePlayers, player.PlayerID)
+
+		if playerDelta := DiffPlayer(basePlayer, player); playerDelta.Changed != 0 {
+			delta.OtherPlayers = append(delta.OtherPlayers, playerDelta)
+		}
+	}
+
+	//Players left in basePlayers are not in the new snapshot
+	for _, player := range base.OtherPlayers {
+		if _, ok := basePlayers[player.PlayerID]; ok {
+			delta.Removed = append(delta.Removed, player.PlayerID)
+		}
+	}
+
+	delta.Entities, delta.RemovedEntities = DiffEntities(base.Entities, snapshot.Entities)
+	return delta
+}
+
+//ApplySnapshotDelta rebuilds the full snapshot from the baseline the delta was made against
+func ApplySnapshotDelta(base Snapshot, delta SnapshotDelta) Snapshot {
+	snapshot := Snapshot{Frame: delta.Frame, Tick: delta.Tick}
+	snapshot.ThisPlayer = ApplyPlayerDelta(base.ThisPlayer, delta.ThisPlayer)
+
+	removed := make(map[uint16]bool, len(delta.Removed))
+	for _, id := range delta.Removed {
+		removed[id] = true
+	}
+	changed := make(map[uint16]PlayerDelta, len(delta.OtherPlayers))
+	for _, playerDelta := range delta.OtherPlayers {
+		changed[playerDelta.Player.PlayerID] = playerDelta
+	}
+
+	snapshot.OtherPlayers = []Player{}
+	for _, player := range base.OtherPlayers {
+		if removed[player.PlayerID] {
+			continue
+		}
+		if playerDelta, ok := changed[player.PlayerID]; ok {
+			player = ApplyPlayerDelta(player, playerDelta)
+			delete(changed, player.PlayerID)
+		}
+		snapshot.OtherPlayers = append(snapshot.OtherPlayers, player)
+	}
+
+	//The remaining players are new since the baseline
+	for _, playerDelta := range delta.OtherPlayers {
+		if _, ok := changed[playerDelta.Player.PlayerID]; ok {
+			snapshot.OtherPlayers = append(snapshot.OtherPlayers, ApplyPlayerDelta(Player{}, playerDelta))
+		}
+	}
+
+	snapshot.Entities = ApplyEntities(base.Entities, delta.Entities, delta.RemovedEntities)
+	return snapshot
+}
+
+func inputsEqual(a, b []Input) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//SnapshotHistorySize is the number of frames kept in a SnapshotHistory
+const SnapshotHistorySize = 32
+
+//SnapshotHistory keeps the last SnapshotHistorySize snapshots so they can be used as baselines
+type SnapshotHistory struct {
+	snapshots [SnapshotHistorySize]Snapshot
+	valid     [SnapshotHistorySize]bool
+}
+
+//Add stores a snapshot, replacing the snapshot SnapshotHistorySize frames older
+func (h *SnapshotHistory) Add(snapshot Snapshot) {
+	i := snapshot.Frame % SnapshotHistorySize
+	h.snapshots[i] = snapshot
+	h.valid[i] = true
+}
+
+//Get returns the snapshot with the frame if it is still in the history
+func (h *SnapshotHistory) Get(frame uint64) (Snapshot, bool) {
+	i := frame % SnapshotHistorySize
+	if !h.valid[i] || h.snapshots[i].Frame != frame {
+		return Snapshot{}, false
+	}
+	return h.snapshots[i], true
+}
@@ -0,0 +1,72 @@
+package networking
+
+import "fmt"
+
+//DisconnectReason tells a peer why its connection was closed. It is sent in Disconnect, in HandshakeReply when a
+//player is rejected and in LeaveEvent
+type DisconnectReason uint8
+
+//DisconnectQuit is sent by a client that leaves by itself
+var DisconnectQuit DisconnectReason = 0
+
+//DisconnectKicked is sent when the server removes a player
+var DisconnectKicked DisconnectReason = 1
+
+//DisconnectBanned is sent when the player is not allowed on the server
+var DisconnectBanned DisconnectReason = 2
+
+//DisconnectServerFull is sent when there is no room for another player
+var DisconnectServerFull DisconnectReason = 3
+
+//DisconnectVersionMismatch is sent when the client and server use different protocol versions
+var DisconnectVersionMismatch DisconnectReason = 4
+
+//DisconnectTimeout is used when nothing could be sent to or recieved from the peer for too long
+var DisconnectTimeout DisconnectReason = 5
+
+//DisconnectServerShutdown is sent to every player when the server stops
+var DisconnectServerShutdown DisconnectReason = 6
+
+//DisconnectRejected is sent when the handshake is refused for another reason, such as an invalid token
+var DisconnectRejected DisconnectReason = 7
+
+//DisconnectViolation is sent when a peer breaks the limits of the protocol, such as by sending too large packets
+//or too many inputs
+var DisconnectViolation DisconnectReason = 8
+
+func (reason DisconnectReason) String() string {
+	switch reason {
+	case DisconnectQuit:
+		return "quit"
+	case DisconnectKicked:
+		return "kicked"
+	case DisconnectBanned:
+		return "banned"
+	case DisconnectServerFull:
+		return "server full"
+	case DisconnectVersionMismatch:
+		return "version mismatch"
+	case DisconnectTimeout:
+		return "timed out"
+	case DisconnectServerShutdown:
+		return "server shut down"
+	case DisconnectRejected:
+		return "rejected"
+	case DisconnectViolation:
+		return "protocol violation"
+	}
+	return fmt.Sprintf("reason %d", uint8(reason))
+}
+
+//DisconnectError is returned when the peer closes the connection with a Disconnect
+type DisconnectError struct {
+	Reason  DisconnectReason
+	Message string
+}
+
+func (e *DisconnectError) Error() string {
+	if e.Message == "" {
+		return "disconnected: " + e.Reason.String()
+	}
+	return "disconnected: " + e.Reason.String() + ": " + e.Message
+}
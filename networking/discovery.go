@@ -0,0 +1,148 @@
+package networking
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+LAN Discovery
+
+Discovery does not use frames, since there is no connection yet. A client broadcasts discoveryQuery on
+DiscoveryPort and every server on the same LAN answers the sender with discoveryReply followed by
+	Version    Uint8 (ProtocolVersion of the server)
+	Name       String
+	Level      String
+	Players    Uvarint
+	MaxPlayers Uvarint
+	Port       Uvarint (port the server accepts players on)
+These fields never change, so clients can list servers of other versions. New fields are added after Port.
+*/
+
+//DiscoveryPort is the UDP port servers listen for discovery queries on
+const DiscoveryPort = 8001
+
+var (
+	discoveryQuery = []byte("RAYCAST?")
+	discoveryReply = []byte("RAYCAST!")
+)
+
+//ServerAnnouncement is what a server tells clients that look for servers on the LAN
+type ServerAnnouncement struct {
+	Version             uint8
+	Name, Level         string
+	Players, MaxPlayers int
+	Port                int
+
+	//Address is host:port of the server. It is filled in by Discover from where the answer came from
+	Address string
+}
+
+func (w *writer) serverAnnouncement(announcement ServerAnnouncement) {
+	w.uint8(announcement.Version)
+	w.string(announcement.Name)
+	w.string(announcement.Level)
+	w.uvarint(uint64(announcement.Players))
+	w.uvarint(uint64(announcement.MaxPlayers))
+	w.uvarint(uint64(announcement.Port))
+}
+
+func (r *reader) serverAnnouncement() ServerAnnouncement {
+	announcement := ServerAnnouncement{}
+	announcement.Version = r.uint8()
+	announcement.Name = r.string()
+	announcement.Level = r.string()
+	announcement.Players = int(r.uvarint())
+	announcement.MaxPlayers = int(r.uvarint())
+	announcement.Port = int(r.uvarint())
+	return announcement
+}
+
+//ServeDiscovery answers discovery queries on the UDP address with the announcement returned by status. Close the
+//returned io.Closer to stop. Only queries from the LAN are answered, so the server can not be used to flood
+//others with replies to spoofed queries
+func ServeDiscovery(address string, status func() ServerAnnouncement) (io.Closer, error) {
+	udpAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.ListenUDP("udp", udpAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		//A larger buffer than the query, so longer datagrams are not cut down to one
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := socket.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !bytes.Equal(buf[:n], discoveryQuery) || !onLAN(from.IP) {
+				continue
+			}
+			w := writer{append([]byte{}, discoveryReply...)}
+			w.serverAnnouncement(status())
+			socket.WriteToUDP(w.buf, from)
+		}
+	}()
+	return socket, nil
+}
+
+//onLAN reports if ip is a loopback, link-local or private address
+func onLAN(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 || (ip4[0] == 172 && ip4[1]&0xf0 == 16) || (ip4[0] == 192 && ip4[1] == 168)
+	}
+	//Unique local addresses, fc00::/7
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+//Discover broadcasts a query on the LAN and returns the servers that answer within timeout
+func Discover(timeout time.Duration) ([]ServerAnnouncement, error) {
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer socket.Close()
+
+	broadcast := &net.UDPAddr{IP: net.IPv4bcast, Port: DiscoveryPort}
+	if _, err := socket.WriteToUDP(discoveryQuery, broadcast); err != nil {
+		return nil, err
+	}
+	socket.SetReadDeadline(time.Now().Add(timeout))
+
+	servers := []ServerAnnouncement{}
+	seen := map[string]bool{}
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := socket.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return servers, nil
+			}
+			return servers, err
+		}
+		if !bytes.HasPrefix(buf[:n], discoveryReply) {
+			continue
+		}
+		r := reader{buf: buf[len(discoveryReply):n]}
+		//Newer servers may add fields at the end, so the rest of the reply is ignored
+		announcement := r.serverAnnouncement()
+		if r.err != nil {
+			continue
+		}
+		announcement.Address = net.JoinHostPort(from.IP.String(), strconv.Itoa(announcement.Port))
+		if !seen[announcement.Address] {
+			seen[announcement.Address] = true
+			servers = append(servers, announcement)
+		}
+	}
+}
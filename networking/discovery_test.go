@@ -0,0 +1,72 @@
+package networking
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServeDiscovery(t *testing.T) {
+	server, err := ServeDiscovery("127.0.0.1:0", func() ServerAnnouncement {
+		return ServerAnnouncement{Name: "test", Port: 8000}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	address := server.(*net.UDPConn).LocalAddr().(*net.UDPAddr)
+
+	socket, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	query := func(datagram []byte) bool {
+		if _, err := socket.WriteToUDP(datagram, address); err != nil {
+			t.Fatal(err)
+		}
+		socket.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, maxDatagramSize)
+		n, _, err := socket.ReadFromUDP(buf)
+		if IsTimeout(err) {
+			return false
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.HasPrefix(buf[:n], discoveryReply)
+	}
+
+	if query(append(append([]byte{}, discoveryQuery...), "and more"...)) {
+		t.Error("a longer datagram starting with the query was answered")
+	}
+	if query(discoveryQuery[:len(discoveryQuery)-1]) {
+		t.Error("a shorter datagram was answered")
+	}
+	if !query(discoveryQuery) {
+		t.Error("the query was not answered")
+	}
+}
+
+func TestOnLAN(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":   true,
+		"10.1.2.3":    true,
+		"172.16.0.1":  true,
+		"172.31.9.9":  true,
+		"172.32.0.1":  false,
+		"192.168.1.1": true,
+		"169.254.1.1": true,
+		"8.8.8.8":     false,
+		"::1":         true,
+		"fe80::1":     true,
+		"fd00::1":     true,
+		"2001:db8::1": false,
+	}
+	for address, want := range tests {
+		if got := onLAN(net.ParseIP(address)); got != want {
+			t.Errorf("onLAN(%s) = %v, want %v", address, got, want)
+		}
+	}
+}
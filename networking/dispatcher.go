@@ -0,0 +1,160 @@
+package networking
+
+import (
+	"fmt"
+	"sync"
+)
+
+//DecodeError is returned when the payload of a packet can not be decoded
+type DecodeError struct {
+	ID  PacketID
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("could not decode packet %d: %v", e.ID, e.Err)
+}
+
+//Unwrap returns the error from the decoder
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+//Dispatcher decodes packets and calls the handler registered for their PacketID
+type Dispatcher struct {
+	handlers map[PacketID]func(data []byte) error
+
+	lock    sync.Mutex
+	unknown map[PacketID]uint64
+}
+
+//NewDispatcher creates a dispatcher without any handlers
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{handlers: make(map[PacketID]func(data []byte) error), unknown: make(map[PacketID]uint64)}
+}
+
+//Dispatch decodes the packet and calls its handler. A *DecodeError is returned if the payload is invalid,
+//otherwise the error from the handler is returned. Packets without a handler are counted, see Unknown
+func (d *Dispatcher) Dispatch(id PacketID, data []byte) error {
+	handler, ok := d.handlers[id]
+	if !ok {
+		d.lock.Lock()
+		d.unknown[id]++
+		d.lock.Unlock()
+		return nil
+	}
+	return handler(data)
+}
+
+//Unknown returns how many packets without a handler were recieved for each PacketID
+func (d *Dispatcher) Unknown() map[PacketID]uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	unknown := make(map[PacketID]uint64, len(d.unknown))
+	for id, count := range d.unknown {
+		unknown[id] = count
+	}
+	return unknown
+}
+
+//on registers a handler that gets the packet decoded by DecodePacket
+func (d *Dispatcher) on(id PacketID, handler func(packet interface{}) error) {
+	d.handlers[id] = func(data []byte) error {
+		packet, err := DecodePacket(id, data)
+		if err != nil {
+			return err
+		}
+		return handler(packet)
+	}
+}
+
+//OnPlayerInfo registers the handler for PlayerInfoPacket
+func (d *Dispatcher) OnPlayerInfo(handler func(PlayerInfo) error) {
+	d.on(PlayerInfoPacket, func(packet interface{}) error {
+		return handler(packet.(PlayerInfo))
+	})
+}
+
+//OnHandshakeReply registers the handler for HandshakeReplyPacket
+func (d *Dispatcher) OnHandshakeReply(handler func(HandshakeReply) error) {
+	d.on(HandshakeReplyPacket, func(packet interface{}) error {
+		return handler(packet.(HandshakeReply))
+	})
+}
+
+//OnInput registers the handler for InputPacket
+func (d *Dispatcher) OnInput(handler func(Input) error) {
+	d.on(InputPacket, func(packet interface{}) error {
+		return handler(packet.(Input))
+	})
+}
+
+//OnInputs registers the handler for InputsPacket
+func (d *Dispatcher) OnInputs(handler func(Inputs) error) {
+	d.on(InputsPacket, func(packet interface{}) error {
+		return handler(packet.(Inputs))
+	})
+}
+
+//OnServerInfo registers the handler for ServerInfoPacket
+func (d *Dispatcher) OnServerInfo(handler func(ServerInfo) error) {
+	d.on(ServerInfoPacket, func(packet interface{}) error {
+		return handler(packet.(ServerInfo))
+	})
+}
+
+//OnSnapshot registers the handler for SnapshotPacket
+func (d *Dispatcher) OnSnapshot(handler func(Snapshot) error) {
+	d.on(SnapshotPacket, func(packet interface{}) error {
+		return handler(packet.(Snapshot))
+	})
+}
+
+//OnSnapshotDelta registers the handler for SnapshotDeltaPacket
+func (d *Dispatcher) OnSnapshotDelta(handler func(SnapshotDelta) error) {
+	d.on(SnapshotDeltaPacket, func(packet interface{}) error {
+		return handler(packet.(SnapshotDelta))
+	})
+}
+
+//OnSnapshotAck registers the handler for SnapshotAckPacket
+func (d *Dispatcher) OnSnapshotAck(handler func(SnapshotAck) error) {
+	d.on(SnapshotAckPacket, func(packet interface{}) error {
+		return handler(packet.(SnapshotAck))
+	})
+}
+
+//OnEvent registers the handler for EventPacket
+func (d *Dispatcher) OnEvent(handler func(Event) error) {
+	d.on(EventPacket, func(packet interface{}) error {
+		return handler(packet.(Event))
+	})
+}
+
+//OnPing registers the handler for PingPacket
+func (d *Dispatcher) OnPing(handler func(Ping) error) {
+	d.on(PingPacket, func(packet interface{}) error {
+		return handler(packet.(Ping))
+	})
+}
+
+//OnPong registers the handler for PongPacket
+func (d *Dispatcher) OnPong(handler func(Pong) error) {
+	d.on(PongPacket, func(packet interface{}) error {
+		return handler(packet.(Pong))
+	})
+}
+
+//OnLevelChange registers the handler for LevelChangePacket
+func (d *Dispatcher) OnLevelChange(handler func(LevelChange) error) {
+	d.on(LevelChangePacket, func(packet interface{}) error {
+		return handler(packet.(LevelChange))
+	})
+}
+
+//OnDisconnect registers the handler for DisconnectPacket
+func (d *Dispatcher) OnDisconnect(handler func(Disconnect) error) {
+	d.on(DisconnectPacket, func(packet interface{}) error {
+		return handler(packet.(Disconnect))
+	})
+}
@@ -0,0 +1,84 @@
+package networking
+
+//EntityKind tells a client what an Entity is
+type EntityKind uint8
+
+//PickupEntity heals the player that walks over it and respawns after a while
+var PickupEntity EntityKind = 0
+
+//PickupAvailable is the State of a pickup that can be taken
+var PickupAvailable uint8 = 0
+
+//PickupTaken is the State of a pickup that is waiting to respawn. It is not drawn
+var PickupTaken uint8 = 1
+
+//Entity is an object in the world that can be spawned, moved, changed or removed while the game runs. Unlike
+//ServerInfo.Sprites entities are sent in every snapshot. EntityID stays the same for the lifetime of the entity
+type Entity struct {
+	EntityID uint32
+	Kind     EntityKind
+	State    uint8
+	Sprite   Sprite
+}
+
+//Hidden reports if the entity is in a state where it should not be drawn
+func (entity Entity) Hidden() bool {
+	return entity.Kind == PickupEntity && entity.State == PickupTaken
+}
+
+//DiffEntities returns the entities that are new or changed since base and the IDs of the entities that were removed
+func DiffEntities(base, entities []Entity) ([]Entity, []uint32) {
+	baseEntities := make(map[uint32]Entity, len(base))
+	for _, entity := range base {
+		baseEntities[entity.EntityID] = entity
+	}
+
+	var changed []Entity
+	for _, entity := range entities {
+		baseEntity, ok := baseEntities[entity.EntityID]
+		delete(baseEntities, entity.EntityID)
+		if !ok || baseEntity != entity {
+			changed = append(changed, entity)
+		}
+	}
+
+	var removed []uint32
+	for _, entity := range base {
+		if _, ok := baseEntities[entity.EntityID]; ok {
+			removed = append(removed, entity.EntityID)
+		}
+	}
+	return changed, removed
+}
+
+//ApplyEntities returns base without the removed entities and with the changed entities replaced or added
+func ApplyEntities(base, changed []Entity, removed []uint32) []Entity {
+	isRemoved := make(map[uint32]bool, len(removed))
+	for _, id := range removed {
+		isRemoved[id] = true
+	}
+	changes := make(map[uint32]Entity, len(changed))
+	for _, entity := range changed {
+		changes[entity.EntityID] = entity
+	}
+
+	entities := []Entity{}
+	for _, entity := range base {
+		if isRemoved[entity.EntityID] {
+			continue
+		}
+		if change, ok := changes[entity.EntityID]; ok {
+			entity = change
+			delete(changes, entity.EntityID)
+		}
+		entities = append(entities, entity)
+	}
+
+	//The remaining entities are new since the baseline
+	for _, entity := range changed {
+		if _, ok := changes[entity.EntityID]; ok {
+			entities = append(entities, entity)
+		}
+	}
+	return entities
+}
@@ -0,0 +1,133 @@
+package networking
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+//Features is a set of optional protocol features. The client sends the features it supports in PlayerInfo
+//and the server answers with the features both sides support
+type Features uint32
+
+//FeatureDeltaSnapshots lets the server send SnapshotDelta against the last snapshot acknowledged with SnapshotAck
+var FeatureDeltaSnapshots Features = 1 << 0
+
+//FeatureSpectator asks the server to let the client watch without playing. A spectator gets no player slot or body,
+//its snapshots contain every player and its inputs are ignored. Clients ask for it in the PlayerInfo given to
+//SendHandshake, and are spectators if it is in the features of the reply
+var FeatureSpectator Features = 1 << 1
+
+//SupportedFeatures contains every feature supported by this build
+var SupportedFeatures Features = FeatureDeltaSnapshots | FeatureSpectator
+
+//requestedFeatures are only sent in PlayerInfo if the client asks for them, since they change how it is treated
+var requestedFeatures = FeatureSpectator
+
+//Has reports if every feature in f2 is in f
+func (f Features) Has(f2 Features) bool {
+	return f&f2 == f2
+}
+
+//errClosedInHandshake is returned if the connection is closed before the handshake is done
+var errClosedInHandshake = errors.New("connection closed during handshake")
+
+//RejectedError is returned by SendHandshake when the server rejects the player
+type RejectedError struct {
+	Code   DisconnectReason
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "rejected by server: " + e.Reason
+}
+
+//SendHandshake sends PlayerInfo to the server and waits for the reply. Version and Features are filled in, keeping
+//FeatureSpectator if it is set. A *RejectedError is returned if the server rejects the player
+func (prot *Protocol) SendHandshake(info PlayerInfo) (HandshakeReply, error) {
+	info.Version = ProtocolVersion
+	info.Features = SupportedFeatures&^requestedFeatures | info.Features&requestedFeatures
+	if err := prot.Send(info, PlayerInfoPacket); err != nil {
+		return HandshakeReply{}, err
+	}
+
+	id, data, err := prot.Recieve()
+	if err == io.EOF {
+		return HandshakeReply{}, errClosedInHandshake
+	}
+	if err != nil {
+		return HandshakeReply{}, err
+	}
+	if id != HandshakeReplyPacket {
+		return HandshakeReply{}, fmt.Errorf("expected handshake reply, got packet %d", id)
+	}
+
+	//The version follows the Accepted byte. A server with another version may have added fields to the reply
+	if len(data) > 1 && data[1] != ProtocolVersion {
+		reason := fmt.Sprintf("server uses protocol version %d, client uses version %d", data[1], ProtocolVersion)
+		return HandshakeReply{Version: data[1]}, &RejectedError{DisconnectVersionMismatch, reason}
+	}
+
+	reply, err := prot.DecodeHandshakeReply(data)
+	if err != nil {
+		return reply, err
+	}
+	if !reply.Accepted {
+		return reply, &RejectedError{reply.Code, reply.Reason}
+	}
+	prot.Features = reply.Features
+	return reply, nil
+}
+
+//RecieveHandshake waits for PlayerInfo from the client. Clients with another protocol version are rejected
+func (prot *Protocol) RecieveHandshake() (PlayerInfo, error) {
+	id, data, err := prot.Recieve()
+	if err == io.EOF {
+		return PlayerInfo{}, errClosedInHandshake
+	}
+	if err != nil {
+		return PlayerInfo{}, err
+	}
+	if id != PlayerInfoPacket {
+		reason := fmt.Sprintf("expected player information, got packet %d", id)
+		prot.RejectHandshake(DisconnectRejected, reason)
+		return PlayerInfo{}, errors.New(reason)
+	}
+
+	//Only the version is checked before the rest is decoded, since the other fields may differ between versions
+	if len(data) > 0 && data[0] != ProtocolVersion {
+		reason := fmt.Sprintf("client uses protocol version %d, server uses version %d", data[0], ProtocolVersion)
+		prot.RejectHandshake(DisconnectVersionMismatch, reason)
+		return PlayerInfo{}, errors.New(reason)
+	}
+
+	info, err := prot.DecodePlayerInfo(data)
+	if err != nil {
+		prot.RejectHandshake(DisconnectRejected, "invalid player information")
+	}
+	return info, err
+}
+
+//AcceptHandshake accepts the player and enables the features supported by both sides. The server fills in
+//SnapshotRate and SessionToken of reply, the other fields are set here
+func (prot *Protocol) AcceptHandshake(info PlayerInfo, reply HandshakeReply) error {
+	return prot.Send(prot.AcceptReply(info, reply), HandshakeReplyPacket)
+}
+
+//AcceptReply enables the features supported by both sides and returns the reply that accepts the player, for
+//servers that send it by themselves. See AcceptHandshake
+func (prot *Protocol) AcceptReply(info PlayerInfo, reply HandshakeReply) HandshakeReply {
+	prot.Features = info.Features & SupportedFeatures
+	reply.Accepted, reply.Version, reply.Features = true, ProtocolVersion, prot.Features
+	return reply
+}
+
+//RejectHandshake tells the client why it can not join
+func (prot *Protocol) RejectHandshake(code DisconnectReason, reason string) error {
+	return prot.Send(RejectReply(code, reason), HandshakeReplyPacket)
+}
+
+//RejectReply returns the reply that tells the client why it can not join
+func RejectReply(code DisconnectReason, reason string) HandshakeReply {
+	return HandshakeReply{Accepted: false, Version: ProtocolVersion, Reason: reason, Code: code}
+}
@@ -0,0 +1,62 @@
+package networking
+
+import (
+	"math"
+	"sync"
+)
+
+//MaxPlayerIDs is the number of different PlayerIDs
+const MaxPlayerIDs = math.MaxUint16 + 1
+
+//PlayerIDs hands out PlayerIDs to at most Max players at a time. IDs that were never used are handed out first,
+//then IDs of players that left are reused oldest first, so a client is unlikely to mix up a new player with one it
+//has just seen leave
+type PlayerIDs struct {
+	Max int
+
+	lock sync.Mutex
+	next int
+	free []uint16
+	used int
+}
+
+//NewPlayerIDs creates an allocator for max players. A max of 0 or more than MaxPlayerIDs allows MaxPlayerIDs
+func NewPlayerIDs(max int) *PlayerIDs {
+	if max <= 0 || max > MaxPlayerIDs {
+		max = MaxPlayerIDs
+	}
+	return &PlayerIDs{Max: max}
+}
+
+//Allocate returns a free PlayerID. It returns false if Max players already have one
+func (ids *PlayerIDs) Allocate() (uint16, bool) {
+	ids.lock.Lock()
+	defer ids.lock.Unlock()
+	if ids.used >= ids.Max {
+		return 0, false
+	}
+	ids.used++
+	if ids.next < MaxPlayerIDs {
+		id := uint16(ids.next)
+		ids.next++
+		return id, true
+	}
+	id := ids.free[0]
+	ids.free = ids.free[1:]
+	return id, true
+}
+
+//Release makes the PlayerID available again. It must only be called once for every ID from Allocate
+func (ids *PlayerIDs) Release(id uint16) {
+	ids.lock.Lock()
+	defer ids.lock.Unlock()
+	ids.used--
+	ids.free = append(ids.free, id)
+}
+
+//Used returns the number of PlayerIDs that are allocated
+func (ids *PlayerIDs) Used() int {
+	ids.lock.Lock()
+	defer ids.lock.Unlock()
+	return ids.used
+}
@@ -0,0 +1,95 @@
+package networking
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	//HandshakeTimeout is how long the server waits for PlayerInfo, and the client for HandshakeReply
+	HandshakeTimeout = 5 * time.Second
+	//IdleTimeout is how long a connection can go without recieving anything before it is closed. Clients send
+	//inputs every tick and the server sends at least MinSnapshotRate snapshots per second
+	IdleTimeout = 10 * time.Second
+
+	//MaxInputRate is the most Input and Inputs packets per second a client may send. Clients send one per tick
+	MaxInputRate = 2 * TickRate
+	//MaxInputBurst is how many input packets may arrive at once, such as after the connection stalled
+	MaxInputBurst = TickRate
+	//MaxControlRate is the most Ping and SnapshotAck packets per second a client may send. Clients ack every
+	//snapshot, and HandshakeReply.SnapshotRate is at most 255
+	MaxControlRate = 2 * 255
+	//MaxControlBurst is how many Ping and SnapshotAck packets may arrive at once
+	MaxControlBurst = 255
+
+	//maxInputSize is the largest encoded size of an Input. MouseX and MouseY are 16 bit and take at most 3 bytes
+	maxInputSize = 2*binary.MaxVarintLen64 + 1 + 2*3
+)
+
+//maxPayloadSizes is the largest payload accepted for packets that are always small, so a peer can not make
+//the other side allocate and read maxFrameSize bytes with them. Other packets are only limited by maxFrameSize
+var maxPayloadSizes = map[PacketID]int{
+	PlayerInfoPacket:  1024,
+	InputPacket:       maxInputSize,
+	InputsPacket:      binary.MaxVarintLen64 + MaxRedundantInputs*maxInputSize,
+	PingPacket:        binary.MaxVarintLen64,
+	PongPacket:        2 * binary.MaxVarintLen64,
+	SnapshotAckPacket: binary.MaxVarintLen64,
+	DisconnectPacket:  1024,
+	EventPacket:       1024,
+	LevelChangePacket: 1024,
+}
+
+//MaxPayloadSize returns the largest payload accepted for the packet
+func MaxPayloadSize(id PacketID) int {
+	if size, ok := maxPayloadSizes[id]; ok {
+		return size
+	}
+	return maxFrameSize - frameHeaderSize
+}
+
+//FrameSizeError is returned by Recieve when a peer sends a packet larger than MaxPayloadSize
+type FrameSizeError struct {
+	ID        PacketID
+	Size, Max int
+}
+
+func (e *FrameSizeError) Error() string {
+	return fmt.Sprintf("packet %d has %d bytes, at most %d are allowed", e.ID, e.Size, e.Max)
+}
+
+//IsTimeout reports if err is from a read deadline passing
+func IsTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+//RateLimiter allows events at a steady rate with bursts of up to burst events
+type RateLimiter struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+//NewRateLimiter creates a limiter that allows rate events per second and starts with a full burst
+func NewRateLimiter(rate, burst float64) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: burst, tokens: burst}
+}
+
+//Allow reports if an event at now is within the limit
+func (l *RateLimiter) Allow(now time.Time) bool {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,230 @@
+package networking
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+//DefaultMemoryTransport is the memory transport registered as "memory"
+var DefaultMemoryTransport = NewMemoryTransport()
+
+var errMemoryClosed = errors.New("use of closed memory connection")
+
+//MemoryTransport connects listeners and dialers in the same process without any sockets. Each MemoryTransport
+//has its own addresses, so separate transports can be used to run isolated servers side by side
+type MemoryTransport struct {
+	lock      sync.Mutex
+	listeners map[string]*memoryListener
+	dials     uint64
+}
+
+//NewMemoryTransport creates a memory transport without any listeners
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{listeners: make(map[string]*memoryListener)}
+}
+
+//Listen accepts connections dialed to the address on this transport
+func (t *MemoryTransport) Listen(address string) (net.Listener, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.listeners[address]; ok {
+		return nil, fmt.Errorf("memory address %q already in use", address)
+	}
+	l := &memoryListener{transport: t, addr: memoryAddr(address), accept: make(chan net.Conn), done: make(chan struct{})}
+	t.listeners[address] = l
+	return l, nil
+}
+
+//Dial connects to the listener on the address. It blocks until the listener accepts the connection
+func (t *MemoryTransport) Dial(address string) (net.Conn, error) {
+	t.lock.Lock()
+	l, ok := t.listeners[address]
+	t.dials++
+	local := memoryAddr(fmt.Sprintf("%s#%d", address, t.dials))
+	t.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no memory listener on %q", address)
+	}
+
+	clientBuffer, serverBuffer := newMemoryBuffer(), newMemoryBuffer()
+	client := &memoryConn{in: clientBuffer, out: serverBuffer, local: local, remote: l.addr}
+	server := &memoryConn{in: serverBuffer, out: clientBuffer, local: l.addr, remote: local}
+
+	select {
+	case l.accept <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("memory listener on %q closed", address)
+	}
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      memoryAddr
+	accept    chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, errMemoryClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.transport.lock.Lock()
+		delete(l.transport.listeners, string(l.addr))
+		l.transport.lock.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+//memoryBuffer holds the bytes written by one side until the other side reads them. Writes never block
+type memoryBuffer struct {
+	lock         sync.Mutex
+	data         []byte
+	closed       bool
+	notify       chan struct{}
+	readDeadline time.Time
+}
+
+func newMemoryBuffer() *memoryBuffer {
+	return &memoryBuffer{notify: make(chan struct{}, 1)}
+}
+
+func (b *memoryBuffer) wake() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (b *memoryBuffer) write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return 0, errMemoryClosed
+	}
+	b.data = append(b.data, p...)
+	b.wake()
+	return len(p), nil
+}
+
+func (b *memoryBuffer) read(p []byte) (int, error) {
+	for {
+		b.lock.Lock()
+		if len(b.data) > 0 {
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			b.lock.Unlock()
+			return n, nil
+		}
+		if b.closed {
+			b.lock.Unlock()
+			return 0, io.EOF
+		}
+		deadline := b.readDeadline
+		b.lock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, timeoutError{}
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-b.notify:
+		case <-timeout:
+			return 0, timeoutError{}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (b *memoryBuffer) close() {
+	b.lock.Lock()
+	b.closed = true
+	b.wake()
+	b.lock.Unlock()
+}
+
+func (b *memoryBuffer) setReadDeadline(t time.Time) {
+	b.lock.Lock()
+	b.readDeadline = t
+	b.wake()
+	b.lock.Unlock()
+}
+
+//memoryConn is one end of a connection made by MemoryTransport
+type memoryConn struct {
+	in, out       *memoryBuffer
+	local, remote memoryAddr
+}
+
+func (c *memoryConn) Read(p []byte) (int, error) {
+	return c.in.read(p)
+}
+
+func (c *memoryConn) Write(p []byte) (int, error) {
+	return c.out.write(p)
+}
+
+//Close closes both directions. The peer can still read what was written before Close
+func (c *memoryConn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.in.setReadDeadline(t)
+	return nil
+}
+
+//SetWriteDeadline does nothing since writes never block
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -1,74 +1,176 @@
 package networking
 
 import (
-	"bytes"
-	"encoding/gob"
+	"bufio"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
+	"sync"
 )
 
 /*
+Frame Structure
+
+Every packet is sent as one frame
+	Length   Uvarint (number of bytes after this field)
+	Version  Uint8   (ProtocolVersion of the sender)
+	PacketID Uint8
+	Payload  [Length-2]Byte (the packet encoded as described in codec.go)
+
+Frames with another Version are rejected, except PlayerInfo and HandshakeReply. Their first fields never
+change so a client and server of different versions can still tell each other why they can not play.
+Frames that are larger than MaxPayloadSize for their PacketID are rejected, see limits.go.
+
 Packet Protocol Structure
 
 Client -> Server
 - Player Information
-	PacketID Uint8
-	Username String
+	Version      Uint8
+	Username     String
+	Token        String (empty unless the server uses a credentials file)
+	Features     Uvarint (FeatureSpectator to watch without playing)
+	SnapshotRate Uint8 (snapshots per second, 0 for the server default)
+	SessionToken String (token from an earlier HandshakeReply to resume, or empty)
 - Input
-	PacketID Uint8
-
-	Up       Uint16
-	Down     Uint16
-	Left     Uint16
-	Right    Uint16
-	MouseX   Uint16
-	MouseY   Uint16
+	Number  Uvarint
+	Tick    Uvarint (server tick the input was made in, see Clock)
+	Buttons Bools (Up, Down, Left, Right, Jump, Shoot)
+	MouseX  Varint
+	MouseY  Varint
+- Ping
+	ClientTime Uvarint (microseconds on the client)
+- Inputs (sent instead of Input, so a lost packet is covered by the next one)
+	Inputs []Input (inputs the server has not acknowledged, oldest first)
 
 Server -> Client
+- Handshake Reply
+	Accepted     Bools
+	Version      Uint8
+	Reason       String
+	Features     Uvarint
+	SnapshotRate Uint8 (the rate the server starts at, it may lower it later)
+	Code         Uint8 (DisconnectReason if not accepted)
+	SessionToken String (sent back in PlayerInfo to resume after the connection drops)
 - Server Information
-	PacketID Uint8
-	PlayerID Uint8
-	Cells    [][]Uint8
-	Sprites  []Sprite
+	ThisPlayer Player
+	Cells      [][]Uint8
+	Sprites    []Sprite (decoration that never changes)
 - Snapshot
-	PacketID     Uint8
-	ThisPlayer   Player
+	Frame        Uvarint
+	Tick         Uvarint
+	ThisPlayer   Player (zero for spectators)
 	OtherPlayers []Player
+	Entities     []Entity
+- Snapshot Delta (only with FeatureDeltaSnapshots)
+	Frame           Uvarint
+	FrameDelta      Uvarint (Frame minus the frame of the baseline)
+	Tick            Uvarint
+	ThisPlayer      PlayerDelta
+	OtherPlayers    []PlayerDelta (players that changed or are new)
+	Removed         []Uvarint (PlayerIDs no longer in OtherPlayers)
+	Entities        []Entity (entities that changed or are new)
+	RemovedEntities []Uvarint (EntityIDs no longer in Entities)
 
-Server <--> Client
+Server -> Client
 - Event
-	PacketID Uint8
-	Event    Event
-*/
+	Event    Uint8
+	PlayerID Uvarint (the player the event is about)
+	OtherID  Uvarint (the attacker for Shot and Kill)
+	Health   Uint8 (health of PlayerID after Shot)
+	Name     String (username for Join and Leave)
+	Reason   Uint8 (DisconnectReason for Leave)
+- Pong
+	ClientTime Uvarint (copied from Ping)
+	ServerTime Uvarint (microseconds since the server started)
+- Level Change (followed by Server Information for the new level)
+	Name String
+	Tick Uvarint (snapshots from before this tick belong to the old level)
 
-//Packet is the struct converted to first to get the PacketID
-type Packet struct {
-	ID   PacketID
-	Data []byte
-}
+Client -> Server
+- Snapshot Ack
+	Frame Uvarint
+
+Server <--> Client
+- Disconnect (the sender closes the connection after it)
+	Reason  Uint8 (DisconnectReason)
+	Message String
+
+Shared structures
+- Player
+	PlayerID        Uvarint
+	LastInputNumber Uvarint
+	LastInputs      []Input
+	X, Y, Z         Float64
+	Angle, Pitch    Float64
+	Vel             Float64
+	Health          Uint8
+- PlayerDelta
+	PlayerID Uvarint
+	Changed  Uvarint (PlayerFields)
+	Only the fields in Changed, in the same order as Player
+- Sprite
+	X, Y, Z, W, H Float64
+	Texture       Uint8
+- Entity
+	EntityID Uvarint
+	Kind     Uint8 (EntityKind)
+	State    Uint8 (depends on Kind)
+	Sprite   Sprite
+*/
 
 /*
 Client -> Server
 */
 
-//PlayerInfo contains information about the player
+//PlayerInfo contains information about the player. It is the first packet sent by the client
 type PlayerInfo struct {
-	Username string
+	Version      uint8
+	Username     string
+	Token        string
+	Features     Features
+	SnapshotRate uint8
+	SessionToken string
 }
 
-//Input contains information about input done by a player
+//Input contains information about input done by a player during the ticks since the previous input
 type Input struct {
-	TimeStamp             float32
+	Tick                  uint64
 	Number                uint64
 	Up, Down, Left, Right bool
 	MouseX, MouseY        int16
 	Jump, Shoot           bool
 }
 
+//Ping asks the server for its time, see Clock
+type Ping struct {
+	ClientTime uint64
+}
+
+//Inputs contains the inputs the server has not acknowledged yet. The server skips inputs it already has by Number
+type Inputs struct {
+	Inputs []Input
+}
+
+//MaxRedundantInputs is the most inputs a client puts in one Inputs. At TickRate it covers a quarter of a second
+//of lost packets
+const MaxRedundantInputs = TickRate / 4
+
 /*
 Server -> Client
 */
 
+//HandshakeReply is the answer to PlayerInfo. If the player is rejected Reason explains why
+type HandshakeReply struct {
+	Accepted     bool
+	Version      uint8
+	Reason       string
+	Features     Features
+	SnapshotRate uint8
+	Code         DisconnectReason
+	SessionToken string
+}
+
 //ServerInfo contains information about the server
 type ServerInfo struct {
 	ThisPlayer Player
@@ -79,109 +181,262 @@ type ServerInfo struct {
 //Snapshot contains information about every player
 type Snapshot struct {
 	Frame        uint64
+	Tick         uint64
 	ThisPlayer   Player
 	OtherPlayers []Player
+	Entities     []Entity
+}
+
+//Pong answers a Ping with the time of the server clock
+type Pong struct {
+	ClientTime uint64
+	ServerTime uint64
+}
+
+//LevelChange tells a client to drop the current world. The server sends ServerInfo with the new level right after it
+type LevelChange struct {
+	Name string
+	Tick uint64
+}
+
+//Event tells a client about something that happened to a player. Events are sent reliably and in order
+type Event struct {
+	Event    EventID
+	PlayerID uint16
+	OtherID  uint16
+	Health   uint8
+	Name     string
+	Reason   DisconnectReason
 }
 
 /*
 Server <--> Client
 */
 
-//Event contains an event, can be sent from both client and server
-type Event struct {
-	Event EventID
+//Disconnect is the last packet sent before a connection is closed
+type Disconnect struct {
+	Reason  DisconnectReason
+	Message string
 }
 
 /*
 Protocol struct
 */
 
-//Protocol is built on top of gob to make communication easier
+//ProtocolVersion is the version of the wire format. It must be increased whenever the encoding of a packet changes
+const ProtocolVersion uint8 = 11
+
+//maxFrameSize is the largest frame that will be accepted from a peer, see also MaxPayloadSize
+const maxFrameSize = 1 << 16
+
+//frameHeaderSize is the size of the version and PacketID fields of a frame
+const frameHeaderSize = 2
+
+//Protocol sends and recieves length-prefixed binary frames over a connection
 type Protocol struct {
-	enc *gob.Encoder
-	dec *gob.Decoder
+	//Features contains the features negotiated in the handshake
+	Features Features
+
+	conn   net.Conn
+	reader *bufio.Reader
+
+	sendLock  sync.Mutex
+	payload   []byte
+	frame     []byte
+	bytesSent uint64
 
-	buffer *bytes.Buffer
-	bufEnc *gob.Encoder
-	bufDec *gob.Decoder
+	//recorder captures the packets of this connection as stream, see Recorder.Record
+	recorder *Recorder
+	stream   uint32
 }
 
 //CreateProtocol creates a new protocol
-func CreateProtocol(conn net.Conn) Protocol {
-	gob.Register(PlayerInfo{})
-	gob.Register(Input{})
-	gob.Register(ServerInfo{})
-	gob.Register(Snapshot{})
-	gob.Register(Event{})
+func CreateProtocol(conn net.Conn) *Protocol {
+	return &Protocol{conn: conn, reader: bufio.NewReader(conn)}
+}
 
-	buffer := &bytes.Buffer{}
+//Send sends the packet. It is safe to call Send from several goroutines
+func (prot *Protocol) Send(data interface{}, id PacketID) error {
+	prot.sendLock.Lock()
+	defer prot.sendLock.Unlock()
 
-	return Protocol{gob.NewEncoder(conn), gob.NewDecoder(conn), buffer, gob.NewEncoder(buffer), gob.NewDecoder(buffer)}
+	payload, err := encodePayload(prot.payload[:0], data)
+	if err != nil {
+		return err
+	}
+	prot.payload = payload
+
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(payload)+frameHeaderSize))
+
+	//The whole frame is written at once so a frame is never split between writes
+	frame := append(prot.frame[:0], length[:n]...)
+	frame = append(frame, ProtocolVersion, uint8(id))
+	frame = append(frame, payload...)
+	prot.frame = frame
+
+	n, err = prot.conn.Write(frame)
+	prot.bytesSent += uint64(n)
+	if err == nil && prot.recorder != nil {
+		prot.recorder.record(prot.stream, DirectionSent, ProtocolVersion, id, payload)
+	}
+	return err
 }
 
-//Send sends the packet
-func (prot *Protocol) Send(data interface{}, id PacketID) error {
-	packet := Packet{}
-	packet.ID = id
+//BytesSent returns the number of bytes written to the connection
+func (prot *Protocol) BytesSent() uint64 {
+	prot.sendLock.Lock()
+	defer prot.sendLock.Unlock()
+	return prot.bytesSent
+}
 
-	prot.bufEnc.Encode(data)
-	packet.Data = prot.buffer.Bytes()
-	prot.buffer.Read(packet.Data)
+//Disconnect tells the peer why the connection is closed and closes it
+func (prot *Protocol) Disconnect(reason DisconnectReason, message string) error {
+	err := prot.Send(Disconnect{Reason: reason, Message: message}, DisconnectPacket)
+	if closeErr := prot.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
 
-	return prot.enc.Encode(packet)
+//Close closes the connection without telling the peer why
+func (prot *Protocol) Close() error {
+	return prot.conn.Close()
 }
 
-//Recieve recieves a packet. PacketID is set to NilPacket if packet is invalid or no packet was found
+//Recieve recieves a packet. io.EOF is returned when the peer has closed the connection and a *FrameSizeError
+//when the packet is larger than MaxPayloadSize. The connection can not be used after a *FrameSizeError
 func (prot *Protocol) Recieve() (PacketID, []byte, error) {
-	var packet Packet
-	err := prot.dec.Decode(&packet)
-	if err == io.EOF {
-		return NilPacket, nil, nil
-	}
+	length, err := binary.ReadUvarint(prot.reader)
 	if err != nil {
 		return NilPacket, nil, err
 	}
-	return packet.ID, packet.Data, nil
+	if length < frameHeaderSize || length > maxFrameSize {
+		return NilPacket, nil, fmt.Errorf("invalid frame length %d", length)
+	}
+
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(prot.reader, header[:]); err != nil {
+		return NilPacket, nil, err
+	}
+	id := PacketID(header[1])
+	if header[0] != ProtocolVersion && id != PlayerInfoPacket && id != HandshakeReplyPacket {
+		return NilPacket, nil, fmt.Errorf("protocol version mismatch: got %d, want %d", header[0], ProtocolVersion)
+	}
+	//The size is checked before the payload is read, so nothing is allocated for a packet that is too large
+	size := int(length) - frameHeaderSize
+	if max := MaxPayloadSize(id); size > max {
+		return id, nil, &FrameSizeError{ID: id, Size: size, Max: max}
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(prot.reader, payload); err != nil {
+		return NilPacket, nil, err
+	}
+	if prot.recorder != nil {
+		prot.recorder.record(prot.stream, DirectionRecieved, header[0], id, payload)
+	}
+	return id, payload, nil
 }
 
-//DecodePlayerInfo decodes []byte sent from server or client to PlayerInfo
-func (prot *Protocol) DecodePlayerInfo(data []byte) PlayerInfo {
-	prot.buffer.Write(data)
-	var playerInfo PlayerInfo
-	prot.bufDec.Decode(&playerInfo)
-	return playerInfo
+//framePacketID returns the PacketID of a frame written by Send
+func framePacketID(frame []byte) PacketID {
+	_, n := binary.Uvarint(frame)
+	if n <= 0 || len(frame) < n+frameHeaderSize {
+		return NilPacket
+	}
+	return PacketID(frame[n+1])
 }
 
-//DecodeInput decodes []byte sent from server or client to Input
-func (prot *Protocol) DecodeInput(data []byte) Input {
-	prot.buffer.Write(data)
-	var input Input
-	prot.bufDec.Decode(&input)
-	return input
+//DecodePlayerInfo decodes []byte sent from server or client to PlayerInfo. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodePlayerInfo(data []byte) (PlayerInfo, error) {
+	packet, err := DecodePacket(PlayerInfoPacket, data)
+	playerInfo, _ := packet.(PlayerInfo)
+	return playerInfo, err
 }
 
-//DecodeServerInfo decodes []byte sent from server or client to ServerInfo
-func (prot *Protocol) DecodeServerInfo(data []byte) ServerInfo {
-	prot.buffer.Write(data)
-	var serverInfo ServerInfo
-	prot.bufDec.Decode(&serverInfo)
-	return serverInfo
+//DecodeHandshakeReply decodes []byte sent from server or client to HandshakeReply. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodeHandshakeReply(data []byte) (HandshakeReply, error) {
+	packet, err := DecodePacket(HandshakeReplyPacket, data)
+	handshakeReply, _ := packet.(HandshakeReply)
+	return handshakeReply, err
+}
+
+//DecodeInput decodes []byte sent from server or client to Input. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodeInput(data []byte) (Input, error) {
+	packet, err := DecodePacket(InputPacket, data)
+	input, _ := packet.(Input)
+	return input, err
+}
+
+//DecodeInputs decodes []byte sent from client to Inputs. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodeInputs(data []byte) (Inputs, error) {
+	packet, err := DecodePacket(InputsPacket, data)
+	inputs, _ := packet.(Inputs)
+	return inputs, err
+}
+
+//DecodeServerInfo decodes []byte sent from server or client to ServerInfo. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodeServerInfo(data []byte) (ServerInfo, error) {
+	packet, err := DecodePacket(ServerInfoPacket, data)
+	serverInfo, _ := packet.(ServerInfo)
+	return serverInfo, err
 }
 
-//DecodeSnapshot decodes []byte sent from server or client to Snapshot
-func (prot *Protocol) DecodeSnapshot(data []byte) Snapshot {
-	prot.buffer.Write(data)
-	var snapshot Snapshot
-	prot.bufDec.Decode(&snapshot)
-	return snapshot
+//DecodeSnapshot decodes []byte sent from server or client to Snapshot. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodeSnapshot(data []byte) (Snapshot, error) {
+	packet, err := DecodePacket(SnapshotPacket, data)
+	snapshot, _ := packet.(Snapshot)
+	return snapshot, err
 }
 
-//DecodeEvent decodes []byte sent from server or client to Event
-func (prot *Protocol) DecodeEvent(data []byte) Event {
-	prot.buffer.Write(data)
-	var event Event
-	prot.bufDec.Decode(&event)
-	return event
+//DecodeSnapshotDelta decodes []byte sent from server or client to SnapshotDelta. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodeSnapshotDelta(data []byte) (SnapshotDelta, error) {
+	packet, err := DecodePacket(SnapshotDeltaPacket, data)
+	snapshotDelta, _ := packet.(SnapshotDelta)
+	return snapshotDelta, err
+}
+
+//DecodeSnapshotAck decodes []byte sent from server or client to SnapshotAck. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodeSnapshotAck(data []byte) (SnapshotAck, error) {
+	packet, err := DecodePacket(SnapshotAckPacket, data)
+	snapshotAck, _ := packet.(SnapshotAck)
+	return snapshotAck, err
+}
+
+//DecodeEvent decodes []byte sent from server to Event. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodeEvent(data []byte) (Event, error) {
+	packet, err := DecodePacket(EventPacket, data)
+	event, _ := packet.(Event)
+	return event, err
+}
+
+//DecodePing decodes []byte sent from client to Ping. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodePing(data []byte) (Ping, error) {
+	packet, err := DecodePacket(PingPacket, data)
+	ping, _ := packet.(Ping)
+	return ping, err
+}
+
+//DecodePong decodes []byte sent from server to Pong. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodePong(data []byte) (Pong, error) {
+	packet, err := DecodePacket(PongPacket, data)
+	pong, _ := packet.(Pong)
+	return pong, err
+}
+
+//DecodeLevelChange decodes []byte sent from server to LevelChange. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodeLevelChange(data []byte) (LevelChange, error) {
+	packet, err := DecodePacket(LevelChangePacket, data)
+	levelChange, _ := packet.(LevelChange)
+	return levelChange, err
+}
+
+//DecodeDisconnect decodes []byte sent from server or client to Disconnect. A *DecodeError is returned if data is invalid
+func (prot *Protocol) DecodeDisconnect(data []byte) (Disconnect, error) {
+	packet, err := DecodePacket(DisconnectPacket, data)
+	disconnect, _ := packet.(Disconnect)
+	return disconnect, err
 }
 
 /*
@@ -196,7 +451,7 @@ type Sprite struct {
 
 //Player contains a snapshot for a player. This includes xyz, pitch and angle
 type Player struct {
-	PlayerID                   uint8
+	PlayerID                   uint16
 	LastInputNumber            uint64
 	LastInputs                 []Input
 	X, Y, Z, Angle, Pitch, Vel float64
@@ -224,18 +479,51 @@ var SnapshotPacket PacketID = 4
 //EventPacket is PacketID for Event
 var EventPacket PacketID = 5
 
-//EventID is used to send events from and to the server
+//HandshakeReplyPacket is PacketID for HandshakeReply
+var HandshakeReplyPacket PacketID = 6
+
+//SnapshotDeltaPacket is PacketID for SnapshotDelta
+var SnapshotDeltaPacket PacketID = 7
+
+//SnapshotAckPacket is PacketID for SnapshotAck
+var SnapshotAckPacket PacketID = 8
+
+//PingPacket is PacketID for Ping
+var PingPacket PacketID = 9
+
+//PongPacket is PacketID for Pong
+var PongPacket PacketID = 10
+
+//DisconnectPacket is PacketID for Disconnect
+var DisconnectPacket PacketID = 11
+
+//InputsPacket is PacketID for Inputs
+var InputsPacket PacketID = 12
+
+//LevelChangePacket is PacketID for LevelChange
+var LevelChangePacket PacketID = 13
+
+//EventID is the kind of an Event
 type EventID uint8
 
-//JumpEvent is an event for jumping, sent from client to server
+//JumpEvent is sent to the other players when PlayerID jumps
 var JumpEvent EventID = 0
 
-//ShootEvent is an event for when a player shoots, sent from client to server
+//ShootEvent is sent to the other players when PlayerID shoots
 var ShootEvent EventID = 1
 
-//ShotEvent is an event for when a player gets shot, sent from server to the client that is shot
+//ShotEvent is sent to the victim PlayerID and the attacker OtherID when a shot hits. Health is left after the hit
 var ShotEvent EventID = 2
 
+//KillEvent is sent to every player when OtherID kills PlayerID. The victim respawns with full health
+var KillEvent EventID = 3
+
+//JoinEvent is sent when PlayerID with Name joins. A new player gets one for every player already playing
+var JoinEvent EventID = 4
+
+//LeaveEvent is sent to every player when PlayerID with Name leaves because of Reason
+var LeaveEvent EventID = 5
+
 /*
 Extra conversion functions
 */
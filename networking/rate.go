@@ -0,0 +1,126 @@
+package networking
+
+import "time"
+
+const (
+	//MinSnapshotRate is the lowest number of snapshots per second a client is sent
+	MinSnapshotRate = 2
+	//MaxClientBandwidth is the number of bytes per second a client can be sent before its snapshot rate is lowered
+	MaxClientBandwidth = 64 * 1024
+
+	//rateAdaptInterval is how often the snapshot rate is adapted
+	rateAdaptInterval = time.Second
+	//maxAckLoss is the share of snapshots that can go unacknowledged before the link is assumed to be congested
+	maxAckLoss = 0.2
+	//maxQueueDelay is how much the round trip time can grow above the lowest seen before the link is assumed to be congested
+	maxQueueDelay = 50 * time.Millisecond
+)
+
+//SnapshotRate decides when a client gets its next snapshot. It starts at the rate the client asked for in the
+//handshake. Every rateAdaptInterval the rate is halved if acks are lost, the round trip time grows or the client
+//is sent more than MaxClientBandwidth, otherwise it is raised by one towards the requested rate. Clients that
+//never ack, such as dashboards without delta snapshots, are not slowed down for losing acks
+type SnapshotRate struct {
+	requested, rate float64
+	next            time.Time
+
+	sentAt [SnapshotHistorySize]time.Time
+	frames [SnapshotHistorySize]uint64
+	acked  [SnapshotHistorySize]bool
+
+	rtt, minRTT time.Duration
+
+	periodStart time.Time
+	periodBytes uint64
+	sent, acks  int
+	//acking is set by the first ack, loss is only measured after it
+	acking bool
+}
+
+//NewSnapshotRate creates a rate starting at requested snapshots per second, clamped to MinSnapshotRate and max
+func NewSnapshotRate(requested, max float64) *SnapshotRate {
+	requested = clampRate(requested, max)
+	return &SnapshotRate{requested: requested, rate: requested}
+}
+
+func clampRate(rate, max float64) float64 {
+	if rate <= 0 || rate > max {
+		return max
+	}
+	if rate < MinSnapshotRate {
+		return MinSnapshotRate
+	}
+	return rate
+}
+
+//Rate returns the current number of snapshots per second
+func (r *SnapshotRate) Rate() float64 {
+	return r.rate
+}
+
+//RTT returns the smoothed time from sending a snapshot until it is acknowledged
+func (r *SnapshotRate) RTT() time.Duration {
+	return r.rtt
+}
+
+//Due reports if the next snapshot should be sent
+func (r *SnapshotRate) Due(now time.Time) bool {
+	return !now.Before(r.next)
+}
+
+//Sent records a snapshot sent at now. bytesSent is the total number of bytes sent to the client, see Protocol.BytesSent
+func (r *SnapshotRate) Sent(frame uint64, now time.Time, bytesSent uint64) {
+	i := frame % SnapshotHistorySize
+	r.sentAt[i], r.frames[i], r.acked[i] = now, frame, false
+	r.sent++
+
+	//Snapshots are scheduled from the last due time, so the rate does not drift with the simulation step
+	interval := time.Duration(float64(time.Second) / r.rate)
+	r.next = r.next.Add(interval)
+	if r.next.Before(now) {
+		r.next = now.Add(interval)
+	}
+
+	if r.periodStart.IsZero() {
+		r.periodStart, r.periodBytes = now, bytesSent
+		return
+	}
+	elapsed := now.Sub(r.periodStart)
+	if elapsed < rateAdaptInterval {
+		return
+	}
+
+	loss := 0.0
+	if r.acking {
+		loss = 1 - float64(r.acks)/float64(r.sent)
+	}
+	bandwidth := float64(bytesSent-r.periodBytes) / elapsed.Seconds()
+	congested := loss > maxAckLoss || bandwidth > MaxClientBandwidth || (r.minRTT > 0 && r.rtt > 2*r.minRTT+maxQueueDelay)
+	if congested {
+		r.rate = clampRate(r.rate/2, r.requested)
+	} else {
+		r.rate = clampRate(r.rate+1, r.requested)
+	}
+	r.periodStart, r.periodBytes, r.sent, r.acks = now, bytesSent, 0, 0
+}
+
+//Acked records the ack of a snapshot. Acks of frames that are not in the history are ignored
+func (r *SnapshotRate) Acked(frame uint64, now time.Time) {
+	i := frame % SnapshotHistorySize
+	if r.frames[i] != frame || r.sentAt[i].IsZero() || r.acked[i] {
+		return
+	}
+	r.acked[i] = true
+	r.acks++
+	r.acking = true
+
+	sample := now.Sub(r.sentAt[i])
+	if r.rtt == 0 {
+		r.rtt = sample
+	} else {
+		r.rtt = (7*r.rtt + sample) / 8
+	}
+	if r.minRTT == 0 || sample < r.minRTT {
+		r.minRTT = sample
+	}
+}
@@ -0,0 +1,39 @@
+package networking
+
+import (
+	"testing"
+	"time"
+)
+
+//sendSnapshots sends snapshots for seconds seconds at the current rate and acks those for which ack returns true
+func sendSnapshots(r *SnapshotRate, seconds int, ack func(frame uint64) bool) {
+	now := time.Unix(0, 0)
+	end := now.Add(time.Duration(seconds) * time.Second)
+	var frame uint64
+	for now.Before(end) {
+		if r.Due(now) {
+			r.Sent(frame, now, 0)
+			if ack(frame) {
+				r.Acked(frame, now.Add(10*time.Millisecond))
+			}
+			frame++
+		}
+		now = now.Add(time.Millisecond)
+	}
+}
+
+func TestSnapshotRateWithoutAcks(t *testing.T) {
+	r := NewSnapshotRate(20, 20)
+	sendSnapshots(r, 10, func(uint64) bool { return false })
+	if r.Rate() != 20 {
+		t.Fatalf("rate of a client that never acks is %v, want 20", r.Rate())
+	}
+}
+
+func TestSnapshotRateLostAcks(t *testing.T) {
+	r := NewSnapshotRate(20, 20)
+	sendSnapshots(r, 10, func(frame uint64) bool { return frame%2 == 0 })
+	if r.Rate() != MinSnapshotRate {
+		t.Fatalf("rate of a client that loses half of its acks is %v, want %v", r.Rate(), MinSnapshotRate)
+	}
+}
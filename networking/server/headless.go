@@ -0,0 +1,16 @@
+//go:build headless
+// +build headless
+
+package main
+
+import "flag"
+
+//showWindow is kept so the same flags and config files work with both builds
+var showWindow = flag.Bool("window", false, "not available, the server was built with -tags headless")
+
+const windowAvailable = false
+
+//runWindow fails since there is no window. main already stops before anything is started if -window is set
+func runWindow() error {
+	return errHeadless
+}
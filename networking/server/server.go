@@ -1,245 +1,194 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math"
 	"net"
-	"sync"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/hajimehoshi/ebiten"
-	"github.com/oyberntzen/Raycasting-in-Golang/game/graphics"
 	"github.com/oyberntzen/Raycasting-in-Golang/game/levels"
-	"github.com/oyberntzen/Raycasting-in-Golang/game/physics"
+	"github.com/oyberntzen/Raycasting-in-Golang/game/server"
 	"github.com/oyberntzen/Raycasting-in-Golang/networking"
 )
 
 var (
-	cells                           [][]uint8
-	sprites                         []networking.Sprite
-	players                         map[uint8]networking.Player
-	playerInputs                    map[uint8][]networking.Input
-	playerProts                     map[uint8]networking.Protocol
-	playerLock, inputLock, protLock sync.Mutex
+	srv      *server.Server
+	recorder *networking.Recorder
+
+	configFile       = flag.String("config", "", "file with one flag per line as name = value, flags on the command line take precedence")
+	address          = flag.String("address", fmt.Sprintf(":%d", defaultPort), "address players connect to with TCP and UDP")
+	stepRate         = flag.Int("step-rate", server.DefaultStepRate, "simulation steps per second, clients get at most this many snapshots per second")
+	modeName         = flag.String("mode", server.DefaultMode, "game mode: "+strings.Join(server.GameModes(), ", "))
+	webSocketAddress = flag.String("ws", "localhost:8080", "address for WebSocket clients such as browser dashboards, empty to disable")
+	webSocketOrigins = flag.String("ws-origins", "", "comma separated origins of web pages such as https://example.com that may connect to -ws besides pages from the same host, * for any")
+	tlsCert          = flag.String("tls-cert", "", "certificate file, enables TLS together with -tls-key")
+	tlsKey           = flag.String("tls-key", "", "private key file for -tls-cert")
+	genCert          = flag.Bool("gen-cert", false, "write a self-signed certificate and key to -tls-cert and -tls-key, then exit")
+	certHosts        = flag.String("cert-hosts", "localhost", "comma separated names and IPs the certificate from -gen-cert is valid for")
+	credentialsFile  = flag.String("credentials", "", "credentials file, players must log in with a token when set")
+	addUser          = flag.String("add-user", "", "add a player to -credentials, print its token and exit")
+	maxPlayers       = flag.Int("max-players", 64, "how many players can be connected or waiting to reconnect at a time")
+	serverName       = flag.String("server-name", defaultServerName(), "name shown in the server list of clients on the LAN")
+	discovery        = flag.String("discovery", fmt.Sprintf(":%d", networking.DiscoveryPort), "UDP address to answer LAN discovery on, empty to disable")
+	levelNames       = flag.String("levels", "Level01,Level02", "comma separated levels to rotate through, starting with the first")
+	levelTime        = flag.Duration("level-time", 0, "how long a level is played before the next in -levels, 0 to only change with the N key")
+	simulated        = networking.NetworkConditionFlags(flag.CommandLine)
+	record           = flag.String("record", "", "capture every packet to this file, see networking/capture")
+	sessionGrace     = flag.Duration("session-grace", 30*time.Second, "how long a dropped player is kept so it can reconnect, 0 to disable")
 )
 
-const (
-	width    int = 500
-	height   int = 500
-	timeStep int = 250
-)
-
-//Game is the struct that implements ebiten.Game
-type Game struct{}
-
-//Exit implements error interface
-type Exit struct{}
-
-func (e *Exit) Error() string {
-	return "Exit game"
-}
-
-//Update handles the logic
-func (g *Game) Update(screen *ebiten.Image) error {
-	if ebiten.IsKeyPressed(ebiten.KeyEscape) {
-		return &Exit{}
-	}
-	return nil
+func init() {
+	//-tick-rate is the old name of -step-rate, kept so existing scripts and config files still work
+	flag.IntVar(stepRate, "tick-rate", server.DefaultStepRate, "deprecated, use -step-rate")
 }
 
-//Draw handles displaying each frame
-func (g *Game) Draw(screen *ebiten.Image) {
-	playersSlice := []networking.Player{}
+//defaultPort is where players connect with TCP and UDP unless -address is set
+const defaultPort = 8000
 
-	playerLock.Lock()
-	for _, player := range players {
-		playersSlice = append(playersSlice, player)
-	}
-	playerLock.Unlock()
-
-	graphics.Draw2D(screen, cells, playersSlice, physics.PlayerSize, width, height)
-}
-
-//Layout returns the size of the canvas
-func (g *Game) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
-	return outsideWidth, outsideHeight
-}
+//errHeadless is returned when -window is set on a server built without the window
+var errHeadless = errors.New("the server was built with -tags headless and can not show a window, use -window=false")
 
 func main() {
-	cells = levels.Level01.Cells
-	sprites = levels.Level01.Sprites
-
-	players = make(map[uint8]networking.Player)
-	playerInputs = make(map[uint8][]networking.Input)
-	playerProts = make(map[uint8]networking.Protocol)
-
-	l, _ := net.Listen("tcp", ":8000")
-	defer l.Close()
-
-	go mainLoop()
-	go handlePlayers(l)
+	flag.Parse()
+	if *configFile != "" {
+		handleError(loadConfig(*configFile))
+	}
 
-	ebiten.SetWindowSize(width, height)
-	ebiten.SetWindowTitle("Raycasting")
-	ebiten.SetRunnableOnUnfocused(true)
-	//ebiten.SetFullscreen(true)
-	if err := ebiten.RunGame(&Game{}); err != nil {
-		log.Fatal(err)
+	if *genCert {
+		handleError(networking.GenerateCertificate(*tlsCert, *tlsKey, strings.Split(*certHosts, ","), 365*24*time.Hour))
+		fmt.Printf("Wrote %s and %s, give %s to the players\n", *tlsCert, *tlsKey, *tlsCert)
+		return
+	}
+	if *addUser != "" {
+		token, err := networking.AddCredential(*credentialsFile, *addUser)
+		handleError(err)
+		fmt.Printf("Token for %s: %s\n", *addUser, token)
+		return
 	}
-}
 
-func mainLoop() {
-	var frame uint64 = 0
-	for {
-		start := getTime()
+	var credentials networking.Credentials
+	var err error
+	if *credentialsFile != "" {
+		credentials, err = networking.LoadCredentials(*credentialsFile)
+		handleError(err)
+	}
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" {
+		tlsConfig, err = networking.LoadServerTLS(*tlsCert, *tlsKey)
+		handleError(err)
+	} else if credentials != nil {
+		log.Println("Warning: tokens are sent in plaintext, use -tls-cert and -tls-key")
+	}
 
-		shots := []networking.Player{}
-		inputLock.Lock()
-		for id, inputs := range playerInputs {
-			for i, input := range inputs {
-				if input.Shoot {
-					playerLock.Lock()
-					player := physics.HandleInputs(players[id], inputs[:i], cells)
-					playerLock.Unlock()
-					player.LastInputs = []networking.Input{input}
-					shots = append(shots, player)
-				}
-			}
+	if *showWindow && !windowAvailable {
+		handleError(errHeadless)
+	}
+	_, portString, err := net.SplitHostPort(*address)
+	handleError(err)
+	port, err := strconv.Atoi(portString)
+	handleError(err)
+	var rotation []levels.Level
+	for _, name := range strings.Split(*levelNames, ",") {
+		next, ok := levels.Find(name)
+		if !ok {
+			handleError(fmt.Errorf("unknown level %q", name))
 		}
+		rotation = append(rotation, next)
+	}
 
-		for id, inputs := range playerInputs {
-			if len(playerInputs[id]) == 0 {
-				continue
-			}
-
-			for _, shot := range shots {
-				if shot.PlayerID == id {
-					continue
-				}
-				timeStamp := shot.LastInputs[0].TimeStamp
-				i := 0
-				for {
-					if i < len(inputs)-1 {
-						if inputs[i+1].TimeStamp < timeStamp {
-							i++
-						}
-					} else {
-						i = len(inputs) - 1
-						break
-					}
-				}
-				fmt.Println(i, timeStamp, inputs[i].TimeStamp)
-			}
-
-			playerInputs[id] = []networking.Input{inputs[len(inputs)-1]}
-			player := players[id]
-
-			player = physics.HandleInputs(player, inputs, cells)
-			player.LastInputNumber = inputs[len(inputs)-1].Number
-			player.LastInputs = inputs
-
-			players[id] = player
+	if *record != "" {
+		recorder, err = networking.CreateRecorder(*record, true)
+		handleError(err)
+	}
+	srv, err = server.New(server.Config{
+		Name:         *serverName,
+		Port:         port,
+		Levels:       rotation,
+		LevelTime:    *levelTime,
+		Mode:         *modeName,
+		StepRate:     *stepRate,
+		MaxPlayers:   *maxPlayers,
+		SessionGrace: *sessionGrace,
+		Credentials:  credentials,
+		Recorder:     recorder,
+	})
+	handleError(err)
+
+	listen := func(transport networking.Transport, address string) {
+		if ws, ok := transport.(networking.WebSocketTransport); ok {
+			ws.TLS = tlsConfig
+			transport = ws
+		} else if tlsConfig != nil {
+			transport = networking.TLSTransport{Transport: transport, Config: tlsConfig}
 		}
-		inputLock.Unlock()
-
-		protLock.Lock()
-		playerLock.Lock()
-		for id, prot := range playerProts {
-			snapshot := networking.Snapshot{}
-			snapshot.ThisPlayer = players[id]
-			snapshot.OtherPlayers = []networking.Player{}
-			snapshot.Frame = frame
-
-			for otherid, otherPlayer := range players {
-				if otherid != id {
-					snapshot.OtherPlayers = append(snapshot.OtherPlayers, otherPlayer)
-				}
+		if simulated.Enabled() {
+			transport = networking.SimulatedTransport{Transport: transport, Conditions: *simulated}
+		}
+		l, err := transport.Listen(address)
+		handleError(err)
+		go func() {
+			if err := srv.Serve(l); err != nil {
+				log.Printf("Stopped accepting players on %v: %v", l.Addr(), err)
 			}
+		}()
+	}
 
-			err := prot.Send(snapshot, networking.SnapshotPacket)
-			if err != nil {
-				deletePlayer(id)
-			}
+	listen(networking.TCPTransport{}, *address)
+	if tlsConfig != nil {
+		log.Println("UDP is disabled since it can not be encrypted")
+	} else if credentials != nil {
+		//A UDP session is only known by its source address, so a spoofed address could send inputs for a player
+		log.Println("UDP is disabled since players log in with -credentials, clients have to use -transport tcp")
+	} else {
+		listen(networking.UDPTransport{}, *address)
+	}
+	if *webSocketAddress != "" {
+		transport := networking.WebSocketTransport{}
+		if *webSocketOrigins != "" {
+			transport.AllowedOrigins = strings.Split(*webSocketOrigins, ",")
 		}
-		protLock.Unlock()
-		playerLock.Unlock()
-		frame++
+		listen(transport, *webSocketAddress)
+	}
 
-		end := getTime()
-		time.Sleep(time.Millisecond*time.Duration(timeStep) - time.Duration((end-start)*1000000000)*time.Nanosecond)
+	if *discovery != "" {
+		if _, err := networking.ServeDiscovery(*discovery, srv.Announcement); err != nil {
+			log.Printf("Not answering LAN discovery: %v", err)
+		}
 	}
-}
 
-func handlePlayers(l net.Listener) {
-	for i := 0; true; i++ {
-		c, _ := l.Accept()
-		go playerConnection(c, uint8(i))
+	srv.Start()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	if *showWindow {
+		go func() {
+			<-interrupt
+			shutdown()
+			os.Exit(0)
+		}()
+		err = runWindow()
+	} else {
+		<-interrupt
 	}
+	shutdown()
+	handleError(err)
 }
 
-func playerConnection(c net.Conn, id uint8) {
-	prot := networking.CreateProtocol(c)
-	thisPlayer := networking.Player{PlayerID: id, X: 22.5, Y: 10.5, Z: 0, Angle: -math.Pi / 2, Pitch: 0, Health: 100}
-	info := networking.ServerInfo{ThisPlayer: thisPlayer, Cells: cells, Sprites: sprites}
-
-	playerLock.Lock()
-	players[id] = thisPlayer
-	playerLock.Unlock()
-
-	lastTime := getTime()
-
-	inputs := []networking.Input{networking.Input{TimeStamp: float32(lastTime)}}
-	inputLock.Lock()
-	playerInputs[id] = inputs
-	inputLock.Unlock()
-
-	protLock.Lock()
-	playerProts[id] = prot
-	protLock.Unlock()
-
-	handleError(prot.Send(info, networking.ServerInfoPacket))
-
-	for {
-		//Handle message from client
-		pid, data, err := prot.Recieve()
-		if err != nil {
-			deletePlayer(id)
-			break
-		}
-
-		if pid != networking.NilPacket {
-			if pid == networking.InputPacket {
-				inputLock.Lock()
-				inputs := playerInputs[id]
-				input := prot.DecodeInput(data)
-				inputs = append(inputs, input)
-				playerInputs[id] = inputs
-				inputLock.Unlock()
-			} /*else if pid == networking.EventPacket {
-				event := prot.DecodeEvent(data)
-
-				if event.Event == networking.JumpEvent {
-					if thisPlayer.Z <= 0 {
-						thisPlayer.Vel = 0.05
-					}
-				} else if event.Event == networking.ShootEvent {
-					players.Range(func(key interface{}, val interface{}) bool {
-						player := val.(networking.Player)
-						pid := key.(uint8)
-						if pid != id {
-							if physics.Hit(thisPlayer, player, cells) {
-								player.Health = uint8(math.Max(float64(player.Health-10), 0))
-								players.Store(pid, player)
-							}
-						}
-						return true
-					})
-				}
-			}*/
-
-		}
+//defaultServerName is the host name of the computer
+func defaultServerName() string {
+	if name, err := os.Hostname(); err == nil {
+		return name
 	}
+	return "Raycasting"
 }
 
 func handleError(err error) {
@@ -252,21 +201,11 @@ func rotate(x, y, a float64) (float64, float64) {
 	return x*math.Cos(a) - y*math.Sin(a), y*math.Cos(a) + x*math.Sin(a)
 }
 
-func getTime() float64 {
-	now := time.Now()
-	return float64(now.Nanosecond())/float64(time.Second) + float64(now.Second())
-}
-
-func deletePlayer(id uint8) {
-	playerLock.Lock()
-	inputLock.Lock()
-	protLock.Lock()
-
-	delete(players, id)
-	delete(playerInputs, id)
-	delete(playerProts, id)
-
-	playerLock.Unlock()
-	inputLock.Unlock()
-	protLock.Unlock()
+//shutdown tells every player that the server stops and waits until they are disconnected
+func shutdown() {
+	srv.Stop()
+	//The Disconnects are in the capture before it is closed
+	if recorder != nil {
+		recorder.Close()
+	}
 }
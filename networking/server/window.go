@@ -0,0 +1,75 @@
+//go:build !headless
+// +build !headless
+
+package main
+
+import (
+	"flag"
+
+	"github.com/hajimehoshi/ebiten"
+	"github.com/oyberntzen/Raycasting-in-Golang/game/graphics"
+	"github.com/oyberntzen/Raycasting-in-Golang/game/physics"
+)
+
+var (
+	showWindow       = flag.Bool("window", true, "show the map and players in a window. This build needs a display even when false, only servers built with -tags headless run without one")
+	pressedNextLevel bool
+)
+
+const (
+	width  int = 500
+	height int = 500
+
+	//windowAvailable is false when the server is built with -tags headless
+	windowAvailable = true
+)
+
+//Game is the struct that implements ebiten.Game
+type Game struct{}
+
+//Exit implements error interface
+type Exit struct{}
+
+func (e *Exit) Error() string {
+	return "Exit game"
+}
+
+//Update handles the logic
+func (g *Game) Update(screen *ebiten.Image) error {
+	if ebiten.IsKeyPressed(ebiten.KeyEscape) {
+		return &Exit{}
+	}
+	if ebiten.IsKeyPressed(ebiten.KeyN) {
+		if !pressedNextLevel {
+			srv.NextLevel()
+			pressedNextLevel = true
+		}
+	} else {
+		pressedNextLevel = false
+	}
+	return nil
+}
+
+//Draw handles displaying each frame
+func (g *Game) Draw(screen *ebiten.Image) {
+	cells, players := srv.View()
+	graphics.Draw2D(screen, cells, players, physics.PlayerSize, width, height)
+}
+
+//Layout returns the size of the canvas
+func (g *Game) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
+	return outsideWidth, outsideHeight
+}
+
+//runWindow shows the map until the window is closed or Escape is pressed. N changes to the next level
+func runWindow() error {
+	ebiten.SetWindowSize(width, height)
+	ebiten.SetWindowTitle("Raycasting")
+	ebiten.SetRunnableOnUnfocused(true)
+	//ebiten.SetFullscreen(true)
+	err := ebiten.RunGame(&Game{})
+	if _, ok := err.(*Exit); ok {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package networking
+
+import (
+	"sync"
+	"time"
+)
+
+//Session is a player whose connection dropped. It is kept so the player can resume with the token it got in
+//HandshakeReply
+type Session struct {
+	Token   string
+	Name    string
+	Player  Player
+	Expires time.Time
+}
+
+//Sessions keeps dropped players for a grace window
+type Sessions struct {
+	Grace time.Duration
+
+	lock     sync.Mutex
+	sessions map[string]Session
+}
+
+//NewSessionToken creates a random token that identifies a player across connections
+func NewSessionToken() (string, error) {
+	return randomToken()
+}
+
+//NewSessions creates an empty store that keeps dropped players for grace. A grace of 0 disables resuming
+func NewSessions(grace time.Duration) *Sessions {
+	return &Sessions{Grace: grace, sessions: make(map[string]Session)}
+}
+
+//Suspend keeps the player until the grace window ends. It returns false if resuming is disabled
+func (s *Sessions) Suspend(token, name string, player Player) bool {
+	if s.Grace <= 0 || token == "" {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[token] = Session{Token: token, Name: name, Player: player, Expires: time.Now().Add(s.Grace)}
+	return true
+}
+
+//Resume removes and returns the session of the token if its grace window has not ended. The name must match the
+//name the session was started with
+func (s *Sessions) Resume(token, name string) (Session, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[token]
+	if !ok || session.Name != name || time.Now().After(session.Expires) {
+		return Session{}, false
+	}
+	delete(s.sessions, token)
+	return session, true
+}
+
+//Respawn replaces the player of every session with spawn, for example when the level changes
+func (s *Sessions) Respawn(spawn func(id uint16) Player) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for token, session := range s.sessions {
+		session.Player = spawn(session.Player.PlayerID)
+		s.sessions[token] = session
+	}
+}
+
+//Expire removes and returns the sessions whose grace window has ended
+func (s *Sessions) Expire(now time.Time) []Session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var expired []Session
+	for token, session := range s.sessions {
+		if now.After(session.Expires) {
+			expired = append(expired, session)
+			delete(s.sessions, token)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,348 @@
+package networking
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//reorderDelay is how much longer than Jitter a reordered frame is held back, so later frames overtake it
+const reorderDelay = 20 * time.Millisecond
+
+var errSimulatedClosed = errors.New("use of closed simulated connection")
+
+//NetworkConditions describes a bad network. Every frame is delayed by Latency plus or minus up to Jitter. Loss,
+//Duplicate and Reorder are chances from 0 to 1 and only apply to unreliable packets, since the transports never
+//lose or reorder reliable packets. The same Seed gives the same decisions for the same frames
+type NetworkConditions struct {
+	Latency, Jitter          time.Duration
+	Loss, Duplicate, Reorder float64
+	Seed                     int64
+}
+
+//NetworkConditionFlags registers -sim-latency, -sim-jitter, -sim-loss, -sim-duplicate, -sim-reorder and -sim-seed.
+//The returned conditions are filled in when flags are parsed
+func NetworkConditionFlags(flags *flag.FlagSet) *NetworkConditions {
+	c := &NetworkConditions{}
+	flags.DurationVar(&c.Latency, "sim-latency", 0, "simulated one way latency added to every frame sent and recieved")
+	flags.DurationVar(&c.Jitter, "sim-jitter", 0, "simulated latency varies by up to this much")
+	flags.Float64Var(&c.Loss, "sim-loss", 0, "chance from 0 to 1 that an unreliable packet is lost")
+	flags.Float64Var(&c.Duplicate, "sim-duplicate", 0, "chance from 0 to 1 that an unreliable packet arrives twice")
+	flags.Float64Var(&c.Reorder, "sim-reorder", 0, "chance from 0 to 1 that an unreliable packet arrives after later packets")
+	flags.Int64Var(&c.Seed, "sim-seed", 1, "seed for the simulated network, the same seed gives the same losses")
+	return c
+}
+
+//Enabled reports if the conditions change anything
+func (c NetworkConditions) Enabled() bool {
+	return c.Latency > 0 || c.Jitter > 0 || c.Loss > 0 || c.Duplicate > 0 || c.Reorder > 0
+}
+
+//SimulatedTransport applies Conditions to both directions of every connection of Transport. The frames must reach
+//it unchanged, so it has to wrap TLSTransport and not the other way around
+type SimulatedTransport struct {
+	Transport  Transport
+	Conditions NetworkConditions
+}
+
+//Listen accepts connections of Transport. Each connection gets its own seed, starting from Conditions.Seed
+func (t SimulatedTransport) Listen(address string) (net.Listener, error) {
+	l, err := t.Transport.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &simulatedListener{Listener: l, conditions: t.Conditions}, nil
+}
+
+//Dial connects with Transport
+func (t SimulatedTransport) Dial(address string) (net.Conn, error) {
+	conn, err := t.Transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return SimulateConn(conn, t.Conditions), nil
+}
+
+type simulatedListener struct {
+	net.Listener
+	conditions NetworkConditions
+	accepted   int64
+}
+
+func (l *simulatedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conditions := l.conditions
+	conditions.Seed += atomic.AddInt64(&l.accepted, 1) - 1
+	return SimulateConn(conn, conditions), nil
+}
+
+//SimulateConn applies the conditions to the frames written to and read from a connection carrying Protocol frames
+func SimulateConn(conn net.Conn, conditions NetworkConditions) net.Conn {
+	c := &simulatedConn{Conn: conn, in: newMemoryBuffer()}
+	c.out = newSimulator(conditions, conditions.Seed, c.deliverOut)
+	//The directions get different seeds so they do not lose the same frames
+	c.incoming = newSimulator(conditions, ^conditions.Seed, c.deliverIn)
+	go c.read()
+	return c
+}
+
+//simulatedConn sends written frames through out and frames read from Conn through incoming into in
+type simulatedConn struct {
+	net.Conn
+	out, incoming *simulator
+	in            *memoryBuffer
+
+	lock     sync.Mutex
+	writeErr error
+	closed   bool
+}
+
+func (c *simulatedConn) deliverOut(frame []byte) {
+	if _, err := c.Conn.Write(frame); err != nil {
+		c.lock.Lock()
+		if c.writeErr == nil {
+			c.writeErr = err
+		}
+		c.lock.Unlock()
+	}
+}
+
+func (c *simulatedConn) deliverIn(frame []byte) {
+	c.in.write(frame)
+}
+
+//read splits what is recieved from Conn into frames and passes them to incoming
+func (c *simulatedConn) read() {
+	reader := bufio.NewReader(c.Conn)
+	for {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil || length > maxFrameSize {
+			c.incoming.finish(c.in.close)
+			return
+		}
+		var prefix [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(prefix[:], length)
+		frame := make([]byte, n+int(length))
+		copy(frame, prefix[:n])
+		if _, err := io.ReadFull(reader, frame[n:]); err != nil {
+			c.incoming.finish(c.in.close)
+			return
+		}
+		c.incoming.send(frame)
+	}
+}
+
+func (c *simulatedConn) Read(p []byte) (int, error) {
+	return c.in.read(p)
+}
+
+//Write never blocks. The frame is written to Conn when its simulated delay has passed
+func (c *simulatedConn) Write(frame []byte) (int, error) {
+	c.lock.Lock()
+	err := c.writeErr
+	if c.closed {
+		err = errSimulatedClosed
+	}
+	c.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	c.out.send(append([]byte{}, frame...))
+	return len(frame), nil
+}
+
+//Close waits until the frames already written have been delivered, so a Disconnect sent right before still
+//arrives, then closes Conn
+func (c *simulatedConn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.lock.Unlock()
+
+	done := make(chan struct{})
+	c.out.finish(func() { close(done) })
+	<-done
+	c.in.close()
+	return c.Conn.Close()
+}
+
+func (c *simulatedConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *simulatedConn) SetReadDeadline(t time.Time) error {
+	c.in.setReadDeadline(t)
+	return nil
+}
+
+//SetWriteDeadline does nothing since writes never block
+func (c *simulatedConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+//simulatedFrame is a frame waiting for its delivery time. A frame without data runs done instead
+type simulatedFrame struct {
+	at   time.Time
+	seq  uint64
+	data []byte
+	done func()
+}
+
+//frameQueue is a heap of frames ordered by delivery time
+type frameQueue []simulatedFrame
+
+func (q frameQueue) Len() int { return len(q) }
+func (q frameQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q frameQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *frameQueue) Push(x interface{}) { *q = append(*q, x.(simulatedFrame)) }
+func (q *frameQueue) Pop() interface{} {
+	old := *q
+	frame := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return frame
+}
+
+//simulator delays the frames of one direction and delivers them one at a time
+type simulator struct {
+	conditions NetworkConditions
+	deliver    func([]byte)
+	//ordered reports if a frame is never lost or reordered, see Reliable
+	ordered func(frame []byte) bool
+
+	lock     sync.Mutex
+	random   *rand.Rand
+	queue    frameQueue
+	seq      uint64
+	latest   time.Time
+	reliable time.Time
+	finished bool
+	wake     chan struct{}
+}
+
+func newSimulator(conditions NetworkConditions, seed int64, deliver func([]byte)) *simulator {
+	s := &simulator{conditions: conditions, deliver: deliver, random: rand.New(rand.NewSource(seed)), wake: make(chan struct{}, 1)}
+	s.ordered = func(frame []byte) bool { return Reliable(framePacketID(frame)) }
+	go s.run()
+	return s
+}
+
+//send schedules the frame. The random numbers are drawn in the same order for every frame, so the decisions only
+//depend on the seed and the frames
+func (s *simulator) send(frame []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.finished {
+		return
+	}
+
+	conditions := s.conditions
+	delay := conditions.Latency
+	if conditions.Jitter > 0 {
+		delay += time.Duration(s.random.Int63n(int64(2*conditions.Jitter)+1)) - conditions.Jitter
+	}
+	lost := s.random.Float64() < conditions.Loss
+	duplicated := s.random.Float64() < conditions.Duplicate
+	reordered := s.random.Float64() < conditions.Reorder
+	if delay < 0 {
+		delay = 0
+	}
+	at := time.Now().Add(delay)
+
+	if s.ordered(frame) {
+		//Reliable frames keep their order, like on a real transport
+		if at.Before(s.reliable) {
+			at = s.reliable
+		}
+		s.reliable = at
+		s.push(simulatedFrame{at: at, data: frame})
+		return
+	}
+	if lost {
+		return
+	}
+	if reordered {
+		at = at.Add(conditions.Jitter + reorderDelay)
+	}
+	s.push(simulatedFrame{at: at, data: frame})
+	if duplicated {
+		s.push(simulatedFrame{at: at, data: frame})
+	}
+}
+
+//finish runs done after every frame sent so far has been delivered. Later frames are dropped
+func (s *simulator) finish(done func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.finished {
+		return
+	}
+	s.finished = true
+	at := time.Now()
+	if s.latest.After(at) {
+		at = s.latest
+	}
+	s.push(simulatedFrame{at: at, done: done})
+}
+
+//push adds a frame to the queue. The lock must be held
+func (s *simulator) push(frame simulatedFrame) {
+	frame.seq = s.seq
+	s.seq++
+	if frame.at.After(s.latest) {
+		s.latest = frame.at
+	}
+	heap.Push(&s.queue, frame)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *simulator) run() {
+	for {
+		s.lock.Lock()
+		if len(s.queue) == 0 {
+			s.lock.Unlock()
+			<-s.wake
+			continue
+		}
+		next := s.queue[0]
+		if wait := time.Until(next.at); wait > 0 {
+			s.lock.Unlock()
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-s.wake:
+				timer.Stop()
+			}
+			continue
+		}
+		heap.Pop(&s.queue)
+		s.lock.Unlock()
+
+		if next.done != nil {
+			next.done()
+			return
+		}
+		s.deliver(next.data)
+	}
+}
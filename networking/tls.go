@@ -0,0 +1,149 @@
+package networking
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+)
+
+/*
+Self-signed certificate workflow
+
+1. Generate a certificate and key on the server machine with GenerateCertificate (server -gen-cert).
+2. Start the server with the certificate and key, see LoadServerTLS.
+3. Copy only the certificate to the players, who trust it with LoadClientTLS (client -tls-ca).
+*/
+
+//errTLSNeedsStream is returned when TLS is used on a transport that may drop frames
+var errTLSNeedsStream = errors.New("TLS needs a reliable stream transport, not UDP")
+
+//GenerateCertificate writes a new self-signed certificate and private key valid for the hosts. Hosts can be names or IP addresses
+func GenerateCertificate(certFile, keyFile string, hosts []string, validFor time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Raycasting server"}},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		//The certificate is its own authority so clients can trust it directly
+		IsCA: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}), 0600)
+}
+
+//LoadServerTLS loads the certificate and key used by the server
+func LoadServerTLS(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+//LoadClientTLS creates a config that only trusts the certificates in caFile, usually the server's self-signed certificate
+func LoadClientTLS(caFile string) (*tls.Config, error) {
+	pemBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
+
+//TLSTransport encrypts the connections of a stream transport such as TCP. A WebSocketTransport is given the
+//config instead, so browsers can connect with wss://
+type TLSTransport struct {
+	Transport Transport
+	Config    *tls.Config
+}
+
+//Listen accepts TLS connections on the underlying transport
+func (t TLSTransport) Listen(address string) (net.Listener, error) {
+	if _, ok := t.Transport.(UDPTransport); ok {
+		return nil, errTLSNeedsStream
+	}
+	if ws, ok := t.Transport.(WebSocketTransport); ok {
+		ws.TLS = t.Config
+		return ws.Listen(address)
+	}
+	l, err := t.Transport.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, t.Config), nil
+}
+
+//Dial connects with the underlying transport and completes the TLS handshake. The host of the address is used
+//to verify the certificate unless Config.ServerName is set
+func (t TLSTransport) Dial(address string) (net.Conn, error) {
+	if _, ok := t.Transport.(UDPTransport); ok {
+		return nil, errTLSNeedsStream
+	}
+	if ws, ok := t.Transport.(WebSocketTransport); ok {
+		ws.TLS = t.Config
+		return ws.Dial(address)
+	}
+	config := t.Config.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config.ServerName = host
+	}
+
+	c, err := t.Transport.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(c, config)
+	if err := tlsConn.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
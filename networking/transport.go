@@ -0,0 +1,91 @@
+package networking
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+//Transport creates the connections Protocol is built on
+type Transport interface {
+	//Listen accepts connections on the address
+	Listen(address string) (net.Listener, error)
+	//Dial connects to a listener on the address
+	Dial(address string) (net.Conn, error)
+}
+
+var (
+	transports    = map[string]Transport{}
+	transportLock sync.Mutex
+)
+
+func init() {
+	RegisterTransport("tcp", TCPTransport{})
+	RegisterTransport("udp", UDPTransport{})
+	RegisterTransport("ws", WebSocketTransport{})
+	RegisterTransport("memory", DefaultMemoryTransport)
+}
+
+//RegisterTransport makes a transport available by name in GetTransport. A transport with the same name is replaced
+func RegisterTransport(name string, transport Transport) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	transports[name] = transport
+}
+
+//GetTransport returns the transport registered with the name
+func GetTransport(name string) (Transport, error) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	transport, ok := transports[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", name)
+	}
+	return transport, nil
+}
+
+//TransportNames returns the names of every registered transport in sorted order
+func TransportNames() []string {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//timeoutError is returned when a read deadline is exceeded
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+//TCPTransport sends frames over a TCP stream
+type TCPTransport struct{}
+
+//Listen listens for TCP connections
+func (TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+//Dial opens a TCP connection
+func (TCPTransport) Dial(address string) (net.Conn, error) {
+	return net.Dial("tcp", address)
+}
+
+//UDPTransport sends frames over UDP with the reliability layer in udp.go
+type UDPTransport struct{}
+
+//Listen listens for UDP sessions
+func (UDPTransport) Listen(address string) (net.Listener, error) {
+	return ListenUDP(address)
+}
+
+//Dial starts a UDP session
+func (UDPTransport) Dial(address string) (net.Conn, error) {
+	return DialUDP(address)
+}
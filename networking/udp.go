@@ -0,0 +1,585 @@
+package networking
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+UDP Transport
+
+Each frame written by Protocol is sent in its own datagram. Frames are either reliable-ordered or
+unreliable-sequenced depending on their PacketID, see Reliable.
+
+Datagram Structure
+	Kind     Uint8
+	Ack      Uint16 (next reliable sequence the sender expects to recieve)
+	Sequence Uint16 (sequence of the frame in its channel)
+	Frame    []Byte
+
+Reliable frames are resent until they are acknowledged and delivered in order. Unreliable frames are
+delivered at most once, and frames older than the last delivered one are dropped.
+*/
+
+const (
+	udpReliable   uint8 = 1
+	udpUnreliable uint8 = 2
+	udpAck        uint8 = 3
+	udpClose      uint8 = 4
+
+	udpHeaderSize    = 5
+	maxDatagramSize  = 65507
+	maxUnacked       = 1024
+	maxQueuedFrames  = 256
+	udpTickInterval  = 20 * time.Millisecond
+	keepAliveTimeout = time.Second
+	udpIdleTimeout   = 10 * time.Second
+	minResendTimeout = 50 * time.Millisecond
+	maxResendTimeout = time.Second
+	udpCloseLinger   = 500 * time.Millisecond
+)
+
+//unreliablePackets are sent unreliable-sequenced over UDP. Every other packet is reliable-ordered
+var unreliablePackets = map[PacketID]bool{
+	InputPacket:         true,
+	InputsPacket:        true,
+	SnapshotPacket:      true,
+	SnapshotDeltaPacket: true,
+	SnapshotAckPacket:   true,
+	//A resent ping would measure the resend timeout instead of the round trip time
+	PingPacket: true,
+	PongPacket: true,
+}
+
+//Reliable reports if packets with the PacketID are resent until they arrive
+func Reliable(id PacketID) bool {
+	return !unreliablePackets[id]
+}
+
+var (
+	errSendWindowFull = errors.New("too many unacknowledged reliable frames")
+	errFrameTooLarge  = errors.New("frame too large for a datagram")
+	errUDPClosed      = errors.New("use of closed connection")
+
+	//errIdleTimeout is a net.Error so it can be told apart from a closed connection
+	errIdleTimeout net.Error = idleTimeoutError{}
+)
+
+type idleTimeoutError struct{}
+
+func (idleTimeoutError) Error() string   { return "connection timed out" }
+func (idleTimeoutError) Timeout() bool   { return true }
+func (idleTimeoutError) Temporary() bool { return false }
+
+type pendingFrame struct {
+	seq      uint16
+	datagram []byte
+	sentAt   time.Time
+	resent   bool
+}
+
+//udpConn is one side of a UDP session. It implements net.Conn so it can be used by Protocol
+type udpConn struct {
+	local, remote net.Addr
+	write         func([]byte) error
+	onClose       func()
+
+	lock     sync.Mutex
+	notify   chan struct{}
+	done     chan struct{}
+	closed   bool
+	closeErr error
+
+	queue   [][]byte
+	current []byte
+
+	sendSeq, recvSeq uint16
+	unacked          []pendingFrame
+	outOfOrder       map[uint16][]byte
+
+	sendUnreliableSeq, recvUnreliableSeq uint16
+	recievedUnreliable                   bool
+
+	rtt                time.Duration
+	lastSend, lastRecv time.Time
+	readDeadline       time.Time
+}
+
+func newUDPConn(local, remote net.Addr, write func([]byte) error, onClose func()) *udpConn {
+	now := time.Now()
+	c := &udpConn{
+		local:      local,
+		remote:     remote,
+		write:      write,
+		onClose:    onClose,
+		notify:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		outOfOrder: make(map[uint16][]byte),
+		lastSend:   now,
+		lastRecv:   now,
+	}
+	go c.tick()
+	return c
+}
+
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func (c *udpConn) header(kind uint8, seq uint16) []byte {
+	datagram := make([]byte, udpHeaderSize, udpHeaderSize+64)
+	datagram[0] = kind
+	binary.LittleEndian.PutUint16(datagram[1:], c.recvSeq)
+	binary.LittleEndian.PutUint16(datagram[3:], seq)
+	return datagram
+}
+
+//Write sends one frame written by Protocol
+func (c *udpConn) Write(frame []byte) (int, error) {
+	if len(frame)+udpHeaderSize > maxDatagramSize {
+		return 0, errFrameTooLarge
+	}
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return 0, errUDPClosed
+	}
+
+	var datagram []byte
+	if Reliable(framePacketID(frame)) {
+		if len(c.unacked) >= maxUnacked {
+			c.lock.Unlock()
+			return 0, errSendWindowFull
+		}
+		datagram = append(c.header(udpReliable, c.sendSeq), frame...)
+		c.unacked = append(c.unacked, pendingFrame{seq: c.sendSeq, datagram: append([]byte{}, datagram...), sentAt: time.Now()})
+		c.sendSeq++
+	} else {
+		datagram = append(c.header(udpUnreliable, c.sendUnreliableSeq), frame...)
+		c.sendUnreliableSeq++
+	}
+	c.lastSend = time.Now()
+	c.lock.Unlock()
+
+	if err := c.write(datagram); err != nil {
+		return 0, err
+	}
+	return len(frame), nil
+}
+
+//handle is called with every datagram recieved from the peer
+func (c *udpConn) handle(datagram []byte) {
+	if len(datagram) < udpHeaderSize {
+		return
+	}
+	kind := datagram[0]
+	ack := binary.LittleEndian.Uint16(datagram[1:])
+	seq := binary.LittleEndian.Uint16(datagram[3:])
+	frame := datagram[udpHeaderSize:]
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.lastRecv = time.Now()
+	c.acknowledge(ack)
+
+	sendAck := false
+	switch kind {
+	case udpReliable:
+		sendAck = true
+		if seq == c.recvSeq {
+			c.deliver(frame)
+			c.recvSeq++
+			for {
+				next, ok := c.outOfOrder[c.recvSeq]
+				if !ok {
+					break
+				}
+				delete(c.outOfOrder, c.recvSeq)
+				c.deliver(next)
+				c.recvSeq++
+			}
+		} else if seqLess(c.recvSeq, seq) && seq-c.recvSeq < maxUnacked {
+			c.outOfOrder[seq] = append([]byte{}, frame...)
+		}
+	case udpUnreliable:
+		if !c.recievedUnreliable || seqLess(c.recvUnreliableSeq, seq) {
+			c.recievedUnreliable = true
+			c.recvUnreliableSeq = seq
+			if len(c.queue) < maxQueuedFrames {
+				c.deliver(frame)
+			}
+		}
+	case udpClose:
+		c.lock.Unlock()
+		c.closeWith(io.EOF, false)
+		return
+	}
+
+	var ackDatagram []byte
+	if sendAck {
+		ackDatagram = c.header(udpAck, 0)
+		c.lastSend = time.Now()
+	}
+	c.lock.Unlock()
+
+	if ackDatagram != nil {
+		c.write(ackDatagram)
+	}
+}
+
+//acknowledge removes every frame the peer has recieved. c.lock must be held
+func (c *udpConn) acknowledge(ack uint16) {
+	i := 0
+	for ; i < len(c.unacked) && seqLess(c.unacked[i].seq, ack); i++ {
+		if !c.unacked[i].resent {
+			sample := time.Since(c.unacked[i].sentAt)
+			if c.rtt == 0 {
+				c.rtt = sample
+			} else {
+				c.rtt = (7*c.rtt + sample) / 8
+			}
+		}
+	}
+	c.unacked = c.unacked[i:]
+}
+
+//deliver queues a frame for Read. c.lock must be held
+func (c *udpConn) deliver(frame []byte) {
+	c.queue = append(c.queue, append([]byte{}, frame...))
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+//tick resends lost reliable frames, keeps the session alive and closes it if the peer is gone
+func (c *udpConn) tick() {
+	ticker := time.NewTicker(udpTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		c.lock.Lock()
+		if now.Sub(c.lastRecv) > udpIdleTimeout {
+			c.lock.Unlock()
+			c.closeWith(errIdleTimeout, true)
+			return
+		}
+
+		timeout := c.resendTimeout()
+		datagrams := [][]byte{}
+		for i := range c.unacked {
+			if now.Sub(c.unacked[i].sentAt) > timeout {
+				//The ack field is refreshed so resent frames also acknowledge what was recieved since
+				binary.LittleEndian.PutUint16(c.unacked[i].datagram[1:], c.recvSeq)
+				c.unacked[i].sentAt = now
+				c.unacked[i].resent = true
+				datagrams = append(datagrams, append([]byte{}, c.unacked[i].datagram...))
+			}
+		}
+		if len(datagrams) == 0 && now.Sub(c.lastSend) > keepAliveTimeout {
+			datagrams = append(datagrams, c.header(udpAck, 0))
+		}
+		if len(datagrams) > 0 {
+			c.lastSend = now
+		}
+		c.lock.Unlock()
+
+		for _, datagram := range datagrams {
+			c.write(datagram)
+		}
+	}
+}
+
+//resendTimeout is how long to wait for an ack before a reliable frame is resent. c.lock must be held
+func (c *udpConn) resendTimeout() time.Duration {
+	timeout := 2 * c.rtt
+	if timeout < minResendTimeout {
+		timeout = minResendTimeout
+	} else if timeout > maxResendTimeout {
+		timeout = maxResendTimeout
+	}
+	return timeout
+}
+
+//RTT returns the smoothed round trip time measured from acknowledged reliable frames
+func (c *udpConn) RTT() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.rtt
+}
+
+func (c *udpConn) Read(b []byte) (int, error) {
+	for {
+		c.lock.Lock()
+		if len(c.current) == 0 && len(c.queue) > 0 {
+			c.current = c.queue[0]
+			c.queue = c.queue[1:]
+		}
+		if len(c.current) > 0 {
+			n := copy(b, c.current)
+			c.current = c.current[n:]
+			c.lock.Unlock()
+			return n, nil
+		}
+		if c.closed {
+			err := c.closeErr
+			c.lock.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.lock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, timeoutError{}
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-c.notify:
+		case <-c.done:
+		case <-timeout:
+			return 0, timeoutError{}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+//closeWith closes the session. Reads return err once every recieved frame is read
+func (c *udpConn) closeWith(err error, notifyPeer bool) {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.closed = true
+	c.closeErr = err
+	close(c.done)
+	var datagram []byte
+	if notifyPeer {
+		datagram = c.header(udpClose, 0)
+	}
+	c.lock.Unlock()
+
+	if datagram != nil {
+		c.write(datagram)
+	}
+	if c.onClose != nil {
+		c.onClose()
+	}
+}
+
+//Close waits up to udpCloseLinger for reliable frames to be acknowledged, so a Disconnect sent just before
+//Close still arrives, and then tells the peer that the session is closed
+func (c *udpConn) Close() error {
+	deadline := time.Now().Add(udpCloseLinger)
+	for time.Now().Before(deadline) {
+		c.lock.Lock()
+		pending := len(c.unacked) > 0 && !c.closed
+		c.lock.Unlock()
+		if !pending {
+			break
+		}
+		time.Sleep(udpTickInterval)
+	}
+	c.closeWith(errUDPClosed, true)
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.readDeadline = t
+	c.lock.Unlock()
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//SetWriteDeadline does nothing since writes never block
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+//DialUDP starts a UDP session with a server
+func DialUDP(address string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+
+	write := func(datagram []byte) error {
+		_, err := socket.Write(datagram)
+		return err
+	}
+	c := newUDPConn(socket.LocalAddr(), raddr, write, func() { socket.Close() })
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := socket.Read(buf)
+			if err != nil {
+				c.closeWith(err, false)
+				return
+			}
+			c.handle(buf[:n])
+		}
+	}()
+	return c, nil
+}
+
+//udpListener accepts UDP sessions on one socket
+type udpListener struct {
+	socket *net.UDPConn
+	accept chan *udpConn
+	done   chan struct{}
+
+	lock  sync.Mutex
+	conns map[string]*udpConn
+}
+
+//ListenUDP listens for UDP sessions. Accept returns a new connection for each new client address
+func ListenUDP(address string) (net.Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &udpListener{socket: socket, accept: make(chan *udpConn, 16), done: make(chan struct{}), conns: make(map[string]*udpConn)}
+	go l.read()
+	return l, nil
+}
+
+func (l *udpListener) read() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.socket.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			continue
+		}
+		if n < udpHeaderSize {
+			continue
+		}
+
+		key := addr.String()
+		l.lock.Lock()
+		c, ok := l.conns[key]
+		//New sessions are dropped while nobody is accepting, the client keeps resending until it is accepted
+		if !ok && (buf[0] == udpReliable || buf[0] == udpUnreliable) && len(l.accept) < cap(l.accept) {
+			c = l.newConn(addr)
+			l.conns[key] = c
+			l.accept <- c
+		}
+		l.lock.Unlock()
+
+		if c != nil {
+			c.handle(buf[:n])
+		}
+	}
+}
+
+func (l *udpListener) newConn(addr *net.UDPAddr) *udpConn {
+	write := func(datagram []byte) error {
+		_, err := l.socket.WriteToUDP(datagram, addr)
+		return err
+	}
+	key := addr.String()
+	var c *udpConn
+	c = newUDPConn(l.socket.LocalAddr(), addr, write, func() {
+		l.lock.Lock()
+		if l.conns[key] == c {
+			delete(l.conns, key)
+		}
+		l.lock.Unlock()
+	})
+	return c
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, errUDPClosed
+	}
+}
+
+//Close stops the listener and closes every session
+func (l *udpListener) Close() error {
+	l.lock.Lock()
+	select {
+	case <-l.done:
+		l.lock.Unlock()
+		return nil
+	default:
+	}
+	close(l.done)
+	conns := make([]*udpConn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.lock.Unlock()
+
+	//Every session lingers for its unacknowledged frames, so they are closed together and not one after the other
+	var closing sync.WaitGroup
+	for _, c := range conns {
+		closing.Add(1)
+		go func(c *udpConn) {
+			defer closing.Done()
+			c.Close()
+		}(c)
+	}
+	closing.Wait()
+	return l.socket.Close()
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.socket.LocalAddr()
+}
@@ -0,0 +1,231 @@
+package networking
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+//badNetwork loses, duplicates and reorders datagrams, including those carrying reliable frames
+var badNetwork = NetworkConditions{Latency: 5 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.3, Duplicate: 0.3, Reorder: 0.3, Seed: 1}
+
+//udpPair connects two UDP sessions through simulators, so every datagram is subject to the conditions like
+//on a real network. The sequence numbers of both channels start at seq
+func udpPair(t *testing.T, conditions NetworkConditions, seq uint16) (*udpConn, *udpConn) {
+	var a, b *udpConn
+	toA := newSimulator(conditions, ^conditions.Seed, func(datagram []byte) { a.handle(datagram) })
+	toB := newSimulator(conditions, conditions.Seed, func(datagram []byte) { b.handle(datagram) })
+	datagrams := func([]byte) bool { return false }
+	toA.ordered, toB.ordered = datagrams, datagrams
+
+	addrA := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	addrB := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}
+	a = newUDPConn(addrA, addrB, func(datagram []byte) error {
+		toB.send(append([]byte{}, datagram...))
+		return nil
+	}, nil)
+	b = newUDPConn(addrB, addrA, func(datagram []byte) error {
+		toA.send(append([]byte{}, datagram...))
+		return nil
+	}, nil)
+	for _, c := range []*udpConn{a, b} {
+		c.lock.Lock()
+		c.sendSeq, c.recvSeq, c.sendUnreliableSeq = seq, seq, seq
+		c.lock.Unlock()
+	}
+
+	t.Cleanup(func() {
+		a.closeWith(errUDPClosed, false)
+		b.closeWith(errUDPClosed, false)
+		toA.finish(func() {})
+		toB.finish(func() {})
+	})
+	return a, b
+}
+
+//testReliable sends events that must all arrive once and in order
+func testReliable(t *testing.T, seq uint16) {
+	a, b := udpPair(t, badNetwork, seq)
+	sender, reciever := CreateProtocol(a), CreateProtocol(b)
+
+	const count = 300
+	go func() {
+		for i := 0; i < count; i++ {
+			if err := sender.Send(Event{Event: JoinEvent, PlayerID: uint16(i)}, EventPacket); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i := 0; i < count; i++ {
+		id, data, err := reciever.Recieve()
+		if err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		event, err := reciever.DecodeEvent(data)
+		if id != EventPacket || err != nil {
+			t.Fatalf("event %d: packet %d, %v", i, id, err)
+		}
+		if event.PlayerID != uint16(i) {
+			t.Fatalf("got event %d, want %d", event.PlayerID, i)
+		}
+	}
+
+	b.lock.Lock()
+	recvSeq := b.recvSeq
+	b.lock.Unlock()
+	if want := seq + count; recvSeq != want {
+		t.Errorf("recieve sequence is %d, want %d", recvSeq, want)
+	}
+
+	//Every frame is acknowledged in the end, also across the wraparound
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.lock.Lock()
+		unacked := len(a.unacked)
+		a.lock.Unlock()
+		if unacked == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d frames were never acknowledged", unacked)
+		}
+		time.Sleep(udpTickInterval)
+	}
+}
+
+func TestUDPReliable(t *testing.T) {
+	testReliable(t, 0)
+}
+
+func TestUDPReliableWraparound(t *testing.T) {
+	testReliable(t, 65500)
+}
+
+//testUnreliable sends pings that may be lost, but must never arrive twice or after a newer ping
+func testUnreliable(t *testing.T, seq uint16) {
+	a, b := udpPair(t, badNetwork, seq)
+	sender, reciever := CreateProtocol(a), CreateProtocol(b)
+
+	const count = 300
+	for i := 1; i <= count; i++ {
+		if err := sender.Send(Ping{ClientTime: uint64(i)}, PingPacket); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var last uint64
+	recieved := 0
+	for {
+		b.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, data, err := reciever.Recieve()
+		if IsTimeout(err) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ping, err := reciever.DecodePing(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ping.ClientTime <= last {
+			t.Fatalf("ping %d arrived after ping %d", ping.ClientTime, last)
+		}
+		last = ping.ClientTime
+		recieved++
+	}
+
+	if recieved == 0 || recieved == count {
+		t.Errorf("%d of %d pings arrived, want some to be lost", recieved, count)
+	}
+	//Pings after the sequence number wrapped must not be taken as old
+	if last < count-10 {
+		t.Errorf("last ping to arrive was %d of %d", last, count)
+	}
+}
+
+func TestUDPUnreliable(t *testing.T) {
+	testUnreliable(t, 0)
+}
+
+func TestUDPUnreliableWraparound(t *testing.T) {
+	testUnreliable(t, 65500)
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		less bool
+	}{
+		{0, 1, true},
+		{1, 0, false},
+		{5, 5, false},
+		{65535, 0, true},
+		{65500, 10, true},
+		{10, 65500, false},
+	}
+	for _, test := range tests {
+		if got := seqLess(test.a, test.b); got != test.less {
+			t.Errorf("seqLess(%d, %d) = %v, want %v", test.a, test.b, got, test.less)
+		}
+	}
+}
+
+func TestUDPClose(t *testing.T) {
+	a, b := udpPair(t, NetworkConditions{Latency: time.Millisecond}, 0)
+	sender, reciever := CreateProtocol(a), CreateProtocol(b)
+
+	//A Disconnect written just before Close still arrives, then the reader sees the end of the session
+	if err := sender.Disconnect(DisconnectQuit, "bye"); err != nil {
+		t.Fatal(err)
+	}
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if id, _, err := reciever.Recieve(); id != DisconnectPacket || err != nil {
+		t.Fatalf("got packet %d, %v", id, err)
+	}
+	if _, _, err := reciever.Recieve(); err == nil || IsTimeout(err) {
+		t.Fatalf("got %v after the peer closed", err)
+	}
+}
+
+func TestUDPListenerClose(t *testing.T) {
+	l, err := ListenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const sessions = 6
+	for i := 0; i < sessions; i++ {
+		conn, err := DialUDP(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateProtocol(conn).Send(Ping{}, PingPacket); err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := CreateProtocol(accepted)
+		accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := server.Recieve(); err != nil {
+			t.Fatal(err)
+		}
+		//The client goes away without telling the server, so this frame is never acknowledged and the session
+		//lingers when it is closed
+		conn.(*udpConn).closeWith(errUDPClosed, false)
+		if err := server.Send(Event{}, EventPacket); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	l.Close()
+	if took := time.Since(start); took > 2*udpCloseLinger {
+		t.Fatalf("closing %d sessions took %v", sessions, took)
+	}
+}
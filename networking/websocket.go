@@ -0,0 +1,216 @@
+package networking
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//WebSocketPath is the HTTP path WebSocketTransport listens on
+const WebSocketPath = "/ws"
+
+var errWebSocketClosed = errors.New("websocket listener closed")
+
+//WebSocketTransport sends each frame as one binary WebSocket message, so browsers can speak the same protocol
+//as TCP clients. Browsers only connect from pages served by the same host as the listener or from AllowedOrigins,
+//so other web pages can not join as the user. Clients that are not browsers send no origin and are always allowed
+type WebSocketTransport struct {
+	//AllowedOrigins are origins such as https://example.com that may connect besides the listener's own host.
+	//"*" allows every origin
+	AllowedOrigins []string
+	//TLS serves and dials wss:// instead of ws:// if set
+	TLS *tls.Config
+}
+
+//Listen serves WebSocket connections on WebSocketPath of the address
+func (t WebSocketTransport) Listen(address string) (net.Listener, error) {
+	socket, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := newWebSocketListener(t)
+	l.socket = socket
+	l.server = &http.Server{Handler: l.handler, TLSConfig: t.TLS}
+	if t.TLS != nil {
+		//The certificate is already in TLSConfig
+		go l.server.ServeTLS(socket, "", "")
+	} else {
+		go l.server.Serve(socket)
+	}
+	return l, nil
+}
+
+//checkOrigin allows requests without an Origin header, from the same host, or from AllowedOrigins
+func (t WebSocketTransport) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range t.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), strings.TrimSuffix(origin, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+//Dial connects to a WebSocket listener. The address is either host:port or a ws:// or wss:// URL
+func (t WebSocketTransport) Dial(address string) (net.Conn, error) {
+	target := address
+	if !strings.HasPrefix(target, "ws://") && !strings.HasPrefix(target, "wss://") {
+		scheme := "ws://"
+		if t.TLS != nil {
+			scheme = "wss://"
+		}
+		target = scheme + address + WebSocketPath
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = t.TLS
+	ws, _, err := dialer.Dial(target, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &webSocketConn{ws: ws}, nil
+}
+
+type webSocketListener struct {
+	socket    net.Listener
+	server    *http.Server
+	handler   http.Handler
+	upgrader  websocket.Upgrader
+	accept    chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+//newWebSocketListener creates a listener that accepts the connections upgraded by its handler
+func newWebSocketListener(t WebSocketTransport) *webSocketListener {
+	l := &webSocketListener{accept: make(chan net.Conn), done: make(chan struct{})}
+	l.upgrader.CheckOrigin = t.checkOrigin
+	mux := http.NewServeMux()
+	mux.HandleFunc(WebSocketPath, l.upgrade)
+	l.handler = mux
+	return l
+}
+
+func (l *webSocketListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	select {
+	case l.accept <- &webSocketConn{ws: ws}:
+	case <-l.done:
+		ws.Close()
+	}
+}
+
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, errWebSocketClosed
+	}
+}
+
+//Close stops accepting connections. Connections that are already accepted stay open
+func (l *webSocketListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *webSocketListener) Addr() net.Addr {
+	return l.socket.Addr()
+}
+
+//webSocketConn implements net.Conn on top of binary WebSocket messages
+type webSocketConn struct {
+	ws     *websocket.Conn
+	reader io.Reader
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+//Write sends b as one binary message. Protocol writes a whole frame at once, so every message is one frame
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *webSocketConn) Close() error {
+	deadline := time.Now().Add(time.Second)
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+	return c.ws.Close()
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *webSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
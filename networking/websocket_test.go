@@ -0,0 +1,195 @@
+package networking
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//webSocketServer serves a listener of the transport with httptest and returns the address to dial
+func webSocketServer(t *testing.T, transport WebSocketTransport) (*webSocketListener, string) {
+	l := newWebSocketListener(transport)
+	server := httptest.NewServer(l.handler)
+	t.Cleanup(server.Close)
+	return l, strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	l, address := webSocketServer(t, WebSocketTransport{})
+
+	accepted := make(chan *Protocol, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			close(accepted)
+			return
+		}
+		accepted <- CreateProtocol(conn)
+	}()
+
+	conn, err := WebSocketTransport{}.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := CreateProtocol(conn)
+	defer client.Close()
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+
+	//Frames of several packets must come out as they went in, in both directions
+	if err := client.Send(Ping{ClientTime: 42}, PingPacket); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := Snapshot{Frame: 7, OtherPlayers: []Player{{PlayerID: 3, LastInputs: []Input{}}}, Entities: []Entity{}, ThisPlayer: Player{LastInputs: []Input{}}}
+	if err := server.Send(snapshot, SnapshotPacket); err != nil {
+		t.Fatal(err)
+	}
+
+	server.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	id, data, err := server.Recieve()
+	if err != nil || id != PingPacket {
+		t.Fatalf("got packet %d, %v", id, err)
+	}
+	if ping, err := server.DecodePing(data); err != nil || ping.ClientTime != 42 {
+		t.Fatalf("got %+v, %v", ping, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	id, data, err = client.Recieve()
+	if err != nil || id != SnapshotPacket {
+		t.Fatalf("got packet %d, %v", id, err)
+	}
+	if got, err := client.DecodeSnapshot(data); err != nil || got.Frame != 7 || len(got.OtherPlayers) != 1 {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+
+	//Closing one side ends the stream of the other
+	client.Close()
+	if _, _, err := server.Recieve(); err == nil {
+		t.Error("no error after the client closed")
+	}
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := GenerateCertificate(certFile, keyFile, []string{"127.0.0.1"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	serverTLS, err := LoadServerTLS(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTLS, err := LoadClientTLS(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The TLS handshake is done by the HTTP server, so wss:// works for browsers
+	l, err := TLSTransport{Transport: WebSocketTransport{}, Config: serverTLS}.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		server := CreateProtocol(conn)
+		server.Send(Pong{ClientTime: 7}, PongPacket)
+	}()
+
+	if _, err := (WebSocketTransport{}).Dial(l.Addr().String()); err == nil {
+		t.Error("ws:// connected to a wss:// listener")
+	}
+	conn, err := WebSocketTransport{TLS: clientTLS}.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := CreateProtocol(conn)
+	defer client.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	id, data, err := client.Recieve()
+	if err != nil || id != PongPacket {
+		t.Fatalf("got packet %d, %v", id, err)
+	}
+	if pong, err := client.DecodePong(data); err != nil || pong.ClientTime != 7 {
+		t.Fatalf("got %+v, %v", pong, err)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	_, address := webSocketServer(t, WebSocketTransport{AllowedOrigins: []string{"https://dashboard.example"}})
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"http://" + address, true},
+		{"https://dashboard.example", true},
+		{"https://DASHBOARD.example/", true},
+		{"https://evil.example", false},
+		{"http://localhost:1", false},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.origin != "" {
+			header.Set("Origin", test.origin)
+		}
+		ws, resp, err := websocket.DefaultDialer.Dial("ws://"+address+WebSocketPath, header)
+		if ws != nil {
+			ws.Close()
+		}
+		if test.allowed && err != nil {
+			t.Errorf("origin %q was rejected: %v", test.origin, err)
+		}
+		if !test.allowed && (err == nil || resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %q was not rejected", test.origin)
+		}
+	}
+}
+
+func TestSpectatorHandshake(t *testing.T) {
+	transport := NewMemoryTransport()
+	l, err := transport.Listen("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		server := CreateProtocol(conn)
+		info, err := server.RecieveHandshake()
+		if err == nil {
+			server.AcceptHandshake(info, HandshakeReply{})
+		}
+	}()
+
+	conn, err := transport.Dial("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := CreateProtocol(conn)
+	defer client.Close()
+	if _, err := client.SendHandshake(PlayerInfo{Username: "dashboard", Features: FeatureSpectator}); err != nil {
+		t.Fatal(err)
+	}
+	if want := SupportedFeatures; client.Features != want {
+		t.Errorf("negotiated features %b, want %b", client.Features, want)
+	}
+}